@@ -0,0 +1,378 @@
+// This file is part of Simurgh.
+// Copyright © 2016 Mike Tigas. All rights reserved.
+// This file is licensed under the terms of the GNU Affero General
+// Public License, version 3 or later. See the LICENSE.md file.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RA reports for the same aircraft less than this far apart belong to the
+// same episode
+const acasEpisodeGap = 30 * time.Second
+
+// ACAS resolution advisory. BDS 3,0 (in Comm-B replies), the DF16 MV field
+// and ES type 28 subtype 2 all lay it out the same way, in message bits
+// 41-88.
+type resolutionAdvisory struct {
+	ara uint // active resolution advisories, 14 bits
+	rac uint // RAs complement, 4 bits
+	rat bool // RA terminated
+	mte bool // multiple threat encounter
+	tti uint // threat type indicator: 1 is an address, 2 altitude/range/bearing
+	tid uint // threat identity data, 26 bits
+}
+
+// decodeResolutionAdvisory reads an RA from a message whose MB/MV/ME field
+// holds one. It reports false if the fields don't make sense together.
+func decodeResolutionAdvisory(message []byte) (resolutionAdvisory, bool) {
+	ra := resolutionAdvisory{
+		ara: mbBits(message, 9, 22),
+		rac: mbBits(message, 23, 26),
+		rat: mbBits(message, 27, 27) == 1,
+		mte: mbBits(message, 28, 28) == 1,
+		tti: mbBits(message, 29, 30),
+		tid: mbBits(message, 31, 56),
+	}
+	// threat type 3 is unassigned, and no threat means no threat data
+	if ra.tti == 3 || (ra.tti == 0 && ra.tid != 0) {
+		return ra, false
+	}
+	// with a threat address the last 2 bits are zero
+	if ra.tti == 1 && ra.tid&3 != 0 {
+		return ra, false
+	}
+	return ra, true
+}
+
+// active reports whether there's an advisory in force. The registers keep
+// their last contents for a while after an RA, with RAT set, so a report
+// with RAT set never counts.
+func (ra resolutionAdvisory) active() bool {
+	return (ra.ara&(1<<13) != 0 || ra.mte) && !ra.rat
+}
+
+// threatAddress is the ICAO address of the threat, if tti is 1.
+func (ra resolutionAdvisory) threatAddress() uint32 {
+	return uint32(ra.tid >> 2)
+}
+
+// threatPosition decodes the threat's altitude (feet), range (nautical
+// miles) and bearing (degrees, relative to our heading) if tti is 2. Any of
+// them can be missing, as math.MaxInt32 or -1.
+func (ra resolutionAdvisory) threatPosition() (altitude int32, distance, bearing float64) {
+	altitude, _ = decodeAC13Field(ra.tid >> 13)
+	if ra.tid>>13 == 0 {
+		altitude = math.MaxInt32
+	}
+
+	distance = -1
+	switch r := (ra.tid >> 6) & 0x7F; {
+	case r == 1:
+		distance = 0.05 // "less than 0.05"
+	case r >= 2 && r <= 126:
+		distance = float64(r-1) / 10
+	case r == 127:
+		distance = 12.55 // "more than 12.55"
+	}
+
+	bearing = -1
+	if b := ra.tid & 0x3F; b >= 1 && b <= 60 {
+		bearing = float64(b-1)*6 + 3 // middle of the 6 degree sector
+	}
+	return
+}
+
+// String spells out the advisory, e.g. "climb, corrective, don't turn left".
+func (ra resolutionAdvisory) String() string {
+	var parts []string
+	bit := func(n uint) bool { return ra.ara&(1<<(13-n)) != 0 }
+
+	if ra.ara&(1<<13) != 0 {
+		// one threat, or several that all call for the same sense
+		downward := bit(2)
+		switch {
+		case bit(6) && downward:
+			parts = append(parts, "descend")
+		case bit(6):
+			parts = append(parts, "climb")
+		case downward:
+			parts = append(parts, "don't climb")
+		default:
+			parts = append(parts, "don't descend")
+		}
+		if bit(3) {
+			parts = append(parts, "increase rate")
+		}
+		if bit(4) {
+			parts = append(parts, "sense reversal")
+		}
+		if bit(5) {
+			parts = append(parts, "altitude crossing")
+		}
+		if bit(1) {
+			parts = append(parts, "corrective")
+		} else {
+			parts = append(parts, "preventive")
+		}
+	} else if ra.mte {
+		// several threats calling for different senses
+		for n, what := range []string{"correct upwards", "climb",
+			"correct downwards", "descend", "crossing", "sense reversal"} {
+			if bit(uint(n + 1)) {
+				parts = append(parts, what)
+			}
+		}
+	}
+
+	for n, what := range []string{"don't pass below", "don't pass above",
+		"don't turn left", "don't turn right"} {
+		if ra.rac&(8>>uint(n)) != 0 {
+			parts = append(parts, what)
+		}
+	}
+	if ra.mte {
+		parts = append(parts, "multiple threats")
+	}
+	if ra.rat {
+		parts = append(parts, "terminated")
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// setRA stores an RA report, starting a new episode if there isn't one
+// going, and marks it for logging if anything changed.
+func (aircraft *aircraftData) setRA(ra resolutionAdvisory, source string) {
+	now := time.Now()
+	ongoing := aircraft.raEpisode != "" && !aircraft.ra.rat &&
+		now.Sub(aircraft.lastRA) <= acasEpisodeGap
+
+	if !ongoing {
+		if !ra.active() {
+			return // leftovers from an RA that's over, or that we didn't see
+		}
+		aircraft.raEpisode = fmt.Sprintf("%s-%d", formatAddress(aircraft.icaoAddr), now.UnixNano()/int64(time.Millisecond))
+		aircraft.raPending = true
+	} else if ra != aircraft.ra {
+		aircraft.raPending = true
+	}
+
+	aircraft.ra = ra
+	aircraft.raSource = source
+	aircraft.lastRA = now
+}
+
+// acasEvent is one line in the -acasLog file: an RA report that started an
+// episode or changed the advisory, with both aircraft as we knew them then.
+type acasEvent struct {
+	Time     time.Time     `json:"time"`
+	Episode  string        `json:"episode"`
+	Source   string        `json:"source"`
+	Advisory string        `json:"advisory"`
+	ARA      uint          `json:"ara"`
+	RAC      uint          `json:"rac"`
+	RAT      bool          `json:"rat"`
+	MTE      bool          `json:"mte"`
+	TTI      uint          `json:"tti"`
+	TID      uint          `json:"tid"`
+	Aircraft acasAircraft  `json:"aircraft"`
+	Threat   *acasAircraft `json:"threat,omitempty"`
+}
+
+type acasAircraft struct {
+	ICAO     string   `json:"icao,omitempty"`
+	Callsign string   `json:"callsign,omitempty"`
+	Category string   `json:"category,omitempty"`
+	Squawk   string   `json:"squawk,omitempty"`
+	Lat      *float64 `json:"lat,omitempty"`
+	Lon      *float64 `json:"lon,omitempty"`
+	Altitude *int32   `json:"altitude,omitempty"` // feet
+	// how far to trust the position: MLAT, or what the aircraft said
+	MLAT         bool  `json:"mlat,omitempty"`
+	NIC          *uint `json:"nic,omitempty"`
+	LowIntegrity bool  `json:"low_integrity,omitempty"`
+	// only for threats reported by altitude/range/bearing
+	RangeNM *float64 `json:"range_nm,omitempty"`
+	Bearing *float64 `json:"bearing,omitempty"`
+}
+
+func newACASAircraft(aircraft *aircraftData) acasAircraft {
+	a := acasAircraft{
+		ICAO:     formatAddress(aircraft.icaoAddr),
+		Callsign: strings.TrimSpace(aircraft.callsign),
+	}
+	if aircraft.category != 0 {
+		a.Category = formatCategory(aircraft.category)
+	}
+	if aircraft.squawk != math.MaxUint16 {
+		a.Squawk = formatSquawk(aircraft.squawk)
+	}
+	if aircraft.latitude != math.MaxFloat64 && aircraft.longitude != math.MaxFloat64 {
+		lat, lon := aircraft.latitude, aircraft.longitude
+		a.Lat, a.Lon = &lat, &lon
+
+		if aircraft.mlat {
+			a.MLAT = true
+		} else if aircraft.posQuality.reported {
+			nic := aircraft.posQuality.nic
+			a.NIC = &nic
+			a.LowIntegrity = aircraft.posQuality.lowIntegrity()
+		}
+	}
+	if aircraft.altitude != math.MaxInt32 {
+		altitude := aircraft.altitude
+		a.Altitude = &altitude
+	}
+	return a
+}
+
+// acasLogger writes to the -acasLog file, one JSON object per line
+var acasLogger struct {
+	lock sync.Mutex
+	enc  *json.Encoder
+}
+
+func setupACASLog() error {
+	if *acasLog == "" {
+		return nil
+	}
+	f, err := os.OpenFile(*acasLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	acasLogger.enc = json.NewEncoder(f)
+	return nil
+}
+
+// recordRA logs the aircraft's pending RA report.
+func recordRA(aircraft *aircraftData, knownAircraft *aircraftMap) {
+	aircraft.raPending = false
+	ra := aircraft.ra
+
+	event := &acasEvent{
+		Time:     aircraft.lastRA.UTC(),
+		Episode:  aircraft.raEpisode,
+		Source:   aircraft.raSource,
+		Advisory: ra.String(),
+		ARA:      ra.ara,
+		RAC:      ra.rac,
+		RAT:      ra.rat,
+		MTE:      ra.mte,
+		TTI:      ra.tti,
+		TID:      ra.tid,
+		Aircraft: newACASAircraft(aircraft),
+	}
+
+	switch ra.tti {
+	case 1:
+		if threat, known := (*knownAircraft)[ra.threatAddress()]; known {
+			t := newACASAircraft(threat)
+			event.Threat = &t
+		} else {
+			event.Threat = &acasAircraft{ICAO: fmt.Sprintf("%06x", ra.threatAddress())}
+		}
+	case 2:
+		altitude, distance, bearing := ra.threatPosition()
+		event.Threat = &acasAircraft{}
+		if altitude != math.MaxInt32 {
+			event.Threat.Altitude = &altitude
+		}
+		if distance >= 0 {
+			event.Threat.RangeNM = &distance
+		}
+		if bearing >= 0 {
+			event.Threat.Bearing = &bearing
+		}
+	}
+
+	acasLogger.lock.Lock()
+	defer acasLogger.lock.Unlock()
+	if acasLogger.enc != nil {
+		if err := acasLogger.enc.Encode(event); err != nil {
+			fmt.Fprintln(os.Stderr, "acas log:", err)
+		}
+	}
+}
+
+// printACASReport reads an -acasLog file and prints one line per RA
+// episode, optionally only those involving the given ICAO address (as the
+// aircraft or the threat).
+func printACASReport(path, icaoFilter string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	icaoFilter = strings.ToLower(icaoFilter)
+	var order []string
+	episodes := make(map[string][]acasEvent)
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		var event acasEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		if _, seen := episodes[event.Episode]; !seen {
+			order = append(order, event.Episode)
+		}
+		episodes[event.Episode] = append(episodes[event.Episode], event)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	fmt.Println("Start\t\t\tSecs\tICAO  \tCallsign\tAlt\tThreat\tThreat alt\tAdvisories")
+	for _, id := range order {
+		events := episodes[id]
+		first, last := events[0], events[len(events)-1]
+
+		threat := first.Threat
+		for _, event := range events {
+			if event.Threat != nil {
+				threat = event.Threat
+			}
+		}
+		if icaoFilter != "" && first.Aircraft.ICAO != icaoFilter &&
+			(threat == nil || threat.ICAO != icaoFilter) {
+			continue
+		}
+
+		sThreat, sThreatAlt := "------", "-----"
+		if threat != nil && threat.ICAO != "" {
+			sThreat = threat.ICAO
+		} else if threat != nil && threat.RangeNM != nil {
+			sThreat = fmt.Sprintf("%.1fnm", *threat.RangeNM)
+		}
+		if threat != nil && threat.Altitude != nil {
+			sThreatAlt = fmt.Sprintf("%d", *threat.Altitude)
+		}
+		sAlt := "-----"
+		if first.Aircraft.Altitude != nil {
+			sAlt = fmt.Sprintf("%d", *first.Aircraft.Altitude)
+		}
+
+		advisories := make([]string, len(events))
+		for i, event := range events {
+			advisories[i] = event.Advisory
+		}
+
+		fmt.Printf("%s\t%4d\t%s\t%8s\t%s\t%s\t%s\t\t%s\n",
+			first.Time.Format(time.RFC3339), int(last.Time.Sub(first.Time).Seconds()),
+			first.Aircraft.ICAO, first.Aircraft.Callsign, sAlt, sThreat, sThreatAlt,
+			strings.Join(advisories, "; "))
+	}
+	return nil
+}
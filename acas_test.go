@@ -0,0 +1,87 @@
+// This file is part of Simurgh.
+// Copyright © 2016 Mike Tigas. All rights reserved.
+// This file is licensed under the terms of the GNU Affero General
+// Public License, version 3 or later. See the LICENSE.md file.
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestSetRAEpisodes(t *testing.T) {
+	climb := resolutionAdvisory{ara: 1<<13 | 1<<12 | 1<<7, tti: 1, tid: 0x4840d6 << 2}
+	increase := climb
+	increase.ara |= 1 << 10
+	terminated := increase
+	terminated.rat = true
+
+	aircraft := aircraftData{icaoAddr: 0x40621d}
+	for i, step := range []struct {
+		ra      resolutionAdvisory
+		logged  bool
+		episode bool // starts a new one
+	}{
+		{terminated, false, false}, // the end of an RA we missed
+		{climb, true, true},
+		{climb, false, false},
+		{increase, true, false},
+		{terminated, true, false},
+		{terminated, false, false}, // still in the registers
+		{terminated, false, false},
+		{climb, true, true},
+	} {
+		aircraft.setRA(step.ra, "test")
+		if aircraft.raPending != step.logged {
+			t.Errorf("step %d: logged %v, want %v", i, aircraft.raPending, step.logged)
+		}
+		// episode IDs are only unique to the millisecond, so mark the one
+		// we've seen to spot the next
+		if started := aircraft.raEpisode != "" && aircraft.raEpisode != "seen"; started != step.episode {
+			t.Errorf("step %d: new episode %v, want %v", i, started, step.episode)
+		}
+		if aircraft.raEpisode != "" {
+			aircraft.raEpisode = "seen"
+		}
+		aircraft.raPending = false
+	}
+}
+
+func TestNewACASAircraft(t *testing.T) {
+	position := func(aircraft *aircraftData) {
+		aircraft.latitude, aircraft.longitude = 52.5, 4.5
+	}
+	tests := []struct {
+		name string
+		set  func(aircraft *aircraftData)
+		want string
+	}{
+		{"bare", func(aircraft *aircraftData) {}, `{"icao":"4840d6"}`},
+		{"category", func(aircraft *aircraftData) { aircraft.category = 0xA3 },
+			`{"icao":"4840d6","category":"A3"}`},
+		{"SBS position", position, `{"icao":"4840d6","lat":52.5,"lon":4.5}`},
+		{"MLAT", func(aircraft *aircraftData) {
+			position(aircraft)
+			aircraft.mlat = true
+		}, `{"icao":"4840d6","lat":52.5,"lon":4.5,"mlat":true}`},
+		{"ADS-B", func(aircraft *aircraftData) {
+			position(aircraft)
+			aircraft.posQuality = positionQuality{reported: true, nic: 8}
+		}, `{"icao":"4840d6","lat":52.5,"lon":4.5,"nic":8}`},
+		{"low integrity", func(aircraft *aircraftData) {
+			position(aircraft)
+			aircraft.posQuality = positionQuality{reported: true, nic: 0}
+		}, `{"icao":"4840d6","lat":52.5,"lon":4.5,"nic":0,"low_integrity":true}`},
+	}
+	for _, test := range tests {
+		aircraft := newAircraftData(0x4840d6)
+		test.set(&aircraft)
+		got, err := json.Marshal(newACASAircraft(&aircraft))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
@@ -7,6 +7,8 @@ package main
 import (
 	"fmt"
 	"math"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -15,23 +17,312 @@ type aircraftData struct {
 
 	callsign string
 
-	eRawLat uint32
-	eRawLon uint32
-	oRawLat uint32
-	oRawLon uint32
+	// emitter category, i.e. 0xA3 for A3; 0 if unknown
+	category uint
+
+	eRawLat  uint32
+	eRawLon  uint32
+	eRawTime time.Time
+	oRawLat  uint32
+	oRawLon  uint32
+	oRawTime time.Time
 
 	latitude  float64
 	longitude float64
-	altitude  int32
+	altitude  int32 // always feet; see altitudeUnit for what was sent
+
+	altitudeUnit altitudeUnit
+	onGround     bool
+
+	// Geometric (GNSS height above the ellipsoid) altitude, kept apart from
+	// the barometric altitude above. Valid if lastGeomAltitude is set.
+	// Derived means it's baro altitude plus the ES type 19 difference rather
+	// than sent directly in an ES type 20-22 position.
+	geomAltitude        int32 // feet
+	geomAltitudeDerived bool
+	lastGeomAltitude    time.Time
+
+	// Mode A code in hex Gillham form (0x7700 is squawk 7700), or
+	// math.MaxUint16 if we haven't seen one
+	squawk        uint
+	squawkHistory []squawkChange
+
+	// ES type 28 emergency state, and the FS field's alert and SPI bits
+	emergencyState uint
+	fsAlert        bool
+	fsSPI          bool
+
+	activeAlerts  alertKind
+	alertLastSeen [alertKindCount]time.Time
+
+	// Velocity (ES type 19, and 5-8 on the surface). Each value is only
+	// valid if its timestamp is non-zero.
+	groundSpeed      float64 // knots
+	track            float64 // degrees
+	airspeed         float64 // knots
+	airspeedIsTrue   bool    // TAS if true, IAS otherwise
+	heading          float64 // degrees, magnetic
+	verticalRate     int32   // ft/min
+	verticalRateGNSS bool    // GNSS if true, barometric otherwise
+	gnssBaroDiff     int32   // GNSS altitude minus baro altitude, feet
+
+	lastGroundSpeed  time.Time
+	lastTrack        time.Time
+	lastAirspeed     time.Time
+	lastHeading      time.Time
+	lastVerticalRate time.Time
+	lastGNSSBaroDiff time.Time
+
+	// Target state (ES type 29), valid if the matching timestamp is set
+	selectedAltitude    int32   // feet
+	selectedAltitudeFMS bool    // from the FMS if true, MCP/FCU otherwise
+	baroSetting         float64 // millibars
+	selectedHeading     float64 // degrees
+	navModes            navMode
+
+	lastSelectedAltitude time.Time
+	lastBaroSetting      time.Time
+	lastSelectedHeading  time.Time
+	lastNavModes         time.Time
+
+	// Operational status (ES type 31), valid if lastOpStatus is set.
+	// adsbVersion is 0 until we hear otherwise.
+	adsbVersion     uint
+	capabilityClass uint // 16 bits airborne, 12 on the surface
+	operationalMode uint
+	nicSupplementA  bool // the only NIC supplement in version 1
+	nicSupplementB  bool // from airborne positions, version 2
+	nicSupplementC  bool // surface, version 2
+	nacp            uint
+	gva             uint // airborne, version 2
+	sil             uint
+	silSupplement   bool // version 2
+	sda             uint // version 2
+	lengthWidth     uint // surface; raw length/width code
+
+	lastOpStatus time.Time
+
+	// Comm-B (DF20/21) only; see commb.go. Valid if the matching timestamp
+	// is set.
+	modeSSubnetVersion uint
+	squitterCapable    bool    // says it can send extended squitters
+	acasRACapable      bool    // ACAS generates RAs, not just TAs
+	gicbCapability     uint    // BDS 1,7 bits 1-24; 0 if unknown
+	roll               float64 // degrees, negative is left wing down
+	trackRate          float64 // degrees/second
+	mach               float64
+
+	lastDataLinkCapability time.Time
+	lastRoll               time.Time
+	lastTrackRate          time.Time
+	lastMach               time.Time
+
+	// Air-air surveillance (DF0/16), valid if the matching timestamp is
+	// set. The DF16 MV field is handled with the RAs below.
+	vsOnGround bool // VS field; separate from onGround, which follows CPR
+	// RI 0 is no ACAS, 2 ACAS with RAs inhibited, 3 vertical RAs only, 4
+	// vertical and horizontal RAs
+	acasCapability uint
+	// RI 8 is no data, 9 up to 75 knots, 10 75-150, 11 150-300, 12
+	// 300-600, 13 600-1200, 14 more than 1200
+	maxAirspeed uint
+
+	lastVerticalStatus time.Time
+	lastACASCapability time.Time
+	lastMaxAirspeed    time.Time
+
+	// The latest ACAS resolution advisory and where it came from, valid if
+	// lastRA is set; see acas.go
+	ra        resolutionAdvisory
+	raSource  string
+	raEpisode string // ID of the RA episode it belongs to
+	raPending bool   // new or changed, and not logged yet
+	lastRA    time.Time
+
+	// integrity and accuracy of the current position
+	posQuality positionQuality
 
 	lastPing time.Time
 	lastPos  time.Time
+	lastES   time.Time // last DF17/18/19
+
+	// positions thrown out by the sanity check: in total, and in a row
+	posRejected uint
+	posFailures uint
+
+	mlat   bool
+	source dataSource
+
+	// frames that only decoded after error correction, and when the last
+	// one came in; posQuality says whether the position is from one
+	correctedFrames uint
+	lastCorrected   time.Time
+}
+
+// positionQuality is what the aircraft said about a position fix: the NIC and
+// containment radius come from the type code and NIC supplements, NACp and
+// SIL from the latest operational status.
+type positionQuality struct {
+	reported bool // false if the position came without them, e.g. from SBS
+
+	nic  uint
+	rc   float64 // meters; 0 if unknown
+	nacp uint
+	sil  uint
+
+	repaired bool // decoded from a frame that needed error correction
+}
+
+// lowIntegrity reports whether a position shouldn't be trusted for much;
+// see lowIntegrityNIC.
+func (q positionQuality) lowIntegrity() bool {
+	return q.reported && q.nic < lowIntegrityNIC
+}
+
+// Where we heard about an aircraft. MLAT is tracked separately.
+type dataSource uint
 
-	mlat bool
+const (
+	sourceNone  dataSource = iota // nothing decoded yet
+	sourceModeS                   // Mode S replies only
+	sourceADSB                    // DF17, or DF18 from a non-transponder device
+	sourceTISB                    // DF18 TIS-B, relayed from ground radar
+	sourceADSR                    // DF18 ADS-R, rebroadcast from another link (UAT)
+	sourceSBS                     // only from SBS BaseStation CSV, already decoded
+)
+
+// directness ranks sources so that a relayed one never replaces a direct
+// one: hearing the aircraft itself beats a rebroadcast of its own ADS-B
+// (ADS-R), which beats a ground radar track (TIS-B). SBS is someone else's
+// decoding, so anything of ours beats it.
+func (source dataSource) directness() int {
+	switch source {
+	case sourceModeS, sourceADSB:
+		return 4
+	case sourceADSR:
+		return 3
+	case sourceTISB:
+		return 2
+	case sourceSBS:
+		return 1
+	}
+	return 0
 }
+
+// setSource records that we heard about the aircraft from source, unless we
+// already have a more direct one.
+func (aircraft *aircraftData) setSource(source dataSource) {
+	if source.directness() >= aircraft.source.directness() {
+		aircraft.source = source
+	}
+}
+
+// DF18 CF (control field) values
+const (
+	cfADSB           = 0 // ADS-B from a non-transponder device
+	cfADSBOther      = 1 // the same, with a non-ICAO (e.g. anonymous) address
+	cfTISBFine       = 2
+	cfTISBCoarse     = 3
+	cfTISBManagement = 4 // TIS-B/ADS-R management; no aircraft
+	cfTISBOther      = 5 // fine TIS-B with a non-ICAO address
+	cfADSR           = 6
+)
+
+// Non-ICAO addresses (TIS-B track numbers, anonymous ADS-B) are kept in
+// aircraftMap with this bit set, so they don't collide with ICAO ones.
+const nonICAOAddress = 1 << 24
+
+// newAircraftData returns an aircraft we know nothing about yet.
+func newAircraftData(icaoAddr uint32) aircraftData {
+	return aircraftData{
+		icaoAddr:  icaoAddr,
+		oRawLat:   math.MaxUint32,
+		oRawLon:   math.MaxUint32,
+		eRawLat:   math.MaxUint32,
+		eRawLon:   math.MaxUint32,
+		latitude:  math.MaxFloat64,
+		longitude: math.MaxFloat64,
+		altitude:  math.MaxInt32,
+		squawk:    math.MaxUint16,
+		callsign:  ""}
+}
+
+// formatAddress prints an ICAO address, or a non-ICAO one with a "~" in
+// front.
+func formatAddress(addr uint32) string {
+	if addr&nonICAOAddress != 0 {
+		return fmt.Sprintf("~%06x", addr&^nonICAOAddress)
+	}
+	return fmt.Sprintf("%06x", addr)
+}
+
+func formatCategory(category uint) string {
+	if category == 0 {
+		return "--"
+	}
+	return fmt.Sprintf("%02X", category)
+}
+
+// parseCategoryList turns a comma separated list like "C1,C2" into a set of
+// categories.
+func parseCategoryList(list string) (map[uint]bool, error) {
+	categories := make(map[uint]bool)
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		// sets A-D, each with categories 0-7
+		category, err := strconv.ParseUint(s, 16, 8)
+		if err != nil || category < 0xA0 || category > 0xDF || category&0xF > 7 {
+			return nil, fmt.Errorf("bad category %q", s)
+		}
+		categories[uint(category)] = true
+	}
+	return categories, nil
+}
+
+type navMode uint
+
+const (
+	navModeAutopilot = navMode(1 << iota)
+	navModeVNAV
+	navModeAltHold
+	navModeApproach
+	navModeLNAV
+)
+
+type squawkChange struct {
+	squawk  uint
+	changed time.Time
+}
+
+// how many squawk changes to remember per aircraft
+const squawkHistoryLen = 10
+
+type altitudeUnit uint8
+
+const (
+	altitudeUnitFeet   = altitudeUnit(0)
+	altitudeUnitMeters = altitudeUnit(1)
+)
+
 type aircraftList []*aircraftData
 type aircraftMap map[uint32]*aircraftData
 
+// setSquawk records a Mode A code, adding it to the history if it changed.
+func (aircraft *aircraftData) setSquawk(squawk uint) {
+	if squawk == aircraft.squawk {
+		return
+	}
+	aircraft.squawk = squawk
+	aircraft.squawkHistory = append(aircraft.squawkHistory,
+		squawkChange{squawk: squawk, changed: time.Now()})
+	if len(aircraft.squawkHistory) > squawkHistoryLen {
+		aircraft.squawkHistory = aircraft.squawkHistory[1:]
+	}
+}
+
 func (a aircraftList) Len() int {
 	return len(a)
 }
@@ -70,5 +361,5 @@ func sortAircraftByCallsign(a aircraftList, i, j int) bool {
 	} else if a[i].callsign == "" && a[j].callsign != "" {
 		return false
 	}
-	return fmt.Sprintf("%06x", a[i].icaoAddr) < fmt.Sprintf("%06x", a[j].icaoAddr)
+	return formatAddress(a[i].icaoAddr) < formatAddress(a[j].icaoAddr)
 }
@@ -0,0 +1,41 @@
+// This file is part of Simurgh.
+// Copyright © 2016 Mike Tigas. All rights reserved.
+// This file is licensed under the terms of the GNU Affero General
+// Public License, version 3 or later. See the LICENSE.md file.
+package main
+
+import "testing"
+
+func TestParseCategoryList(t *testing.T) {
+	tests := []struct {
+		list string
+		want []uint
+		ok   bool
+	}{
+		{"", nil, true},
+		{"C1,C2", []uint{0xC1, 0xC2}, true},
+		{" a3 , B7", []uint{0xA3, 0xB7}, true},
+		{"A0,D7", []uint{0xA0, 0xD7}, true},
+		{"A8", nil, false},
+		{"CF", nil, false},
+		{"E1", nil, false},
+		{"9F", nil, false},
+		{"C1,XX", nil, false},
+	}
+	for _, test := range tests {
+		categories, err := parseCategoryList(test.list)
+		if (err == nil) != test.ok {
+			t.Errorf("%q: error %v, want ok %v", test.list, err, test.ok)
+			continue
+		}
+		if len(categories) != len(test.want) {
+			t.Errorf("%q: got %v, want %X", test.list, categories, test.want)
+			continue
+		}
+		for _, category := range test.want {
+			if !categories[category] {
+				t.Errorf("%q: %X missing", test.list, category)
+			}
+		}
+	}
+}
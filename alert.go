@@ -0,0 +1,208 @@
+// This file is part of Simurgh.
+// Copyright © 2016 Mike Tigas. All rights reserved.
+// This file is licensed under the terms of the GNU Affero General
+// Public License, version 3 or later. See the LICENSE.md file.
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+type alertKind uint
+
+const (
+	alertHijack       = alertKind(1 << iota) // squawk 7500
+	alertRadioFailure                        // squawk 7600
+	alertEmergency                           // squawk 7700
+	alertESEmergency                         // ES type 28 emergency/priority status
+	alertFlightStatus                        // alert bit in the FS field
+	alertSPI                                 // ident (SPI) bit in the FS field
+
+	alertKindCount = 6
+)
+
+// An alert stays active (and won't fire again) until its condition has been
+// gone for this long, so flags that come and go between replies don't spam.
+const alertClearAfter = 60 * time.Second
+
+// ES type 28 subtype 1 emergency states
+var esEmergencyStates = []string{
+	"no emergency",
+	"general emergency",
+	"lifeguard/medical emergency",
+	"minimum fuel",
+	"no communications",
+	"unlawful interference",
+	"downed aircraft",
+	"reserved",
+}
+
+func (kind alertKind) String() string {
+	switch kind {
+	case alertHijack:
+		return "squawk 7500 (hijack)"
+	case alertRadioFailure:
+		return "squawk 7600 (radio failure)"
+	case alertEmergency:
+		return "squawk 7700 (emergency)"
+	case alertESEmergency:
+		return "emergency/priority status"
+	case alertFlightStatus:
+		return "flight status alert"
+	case alertSPI:
+		return "ident (SPI)"
+	}
+	return "unknown"
+}
+
+type alertEvent struct {
+	time     time.Time
+	icaoAddr uint32
+	callsign string
+	category uint
+	squawk   uint
+	kind     alertKind
+	detail   string
+}
+
+func (alert *alertEvent) String() string {
+	s := fmt.Sprintf("%s ALERT %s %-8s %s %s %s", alert.time.UTC().Format(time.RFC3339),
+		formatAddress(alert.icaoAddr), strings.TrimSpace(alert.callsign), formatCategory(alert.category),
+		formatSquawk(alert.squawk), alert.kind)
+	if alert.detail != "" {
+		s += ": " + alert.detail
+	}
+	return s
+}
+
+type alertSink interface {
+	deliver(alert *alertEvent)
+}
+
+// alertSinks is set up from the command line flags in main
+var alertSinks []alertSink
+
+// Writes one line per alert, e.g. to stderr or a log file
+type writerAlertSink struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+func (sink *writerAlertSink) deliver(alert *alertEvent) {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	fmt.Fprintln(sink.w, alert.String())
+}
+
+// Runs a shell command for each alert, with the details in the environment
+type execAlertSink struct {
+	command string
+}
+
+func (sink *execAlertSink) deliver(alert *alertEvent) {
+	// through the shell, so the flag can have arguments, pipes etc.
+	cmd := exec.Command("sh", "-c", sink.command)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("SIMURGH_ALERT=%s", alert.kind),
+		fmt.Sprintf("SIMURGH_ALERT_DETAIL=%s", alert.detail),
+		fmt.Sprintf("SIMURGH_ICAO=%s", formatAddress(alert.icaoAddr)),
+		fmt.Sprintf("SIMURGH_CALLSIGN=%s", strings.TrimSpace(alert.callsign)),
+		fmt.Sprintf("SIMURGH_CATEGORY=%s", formatCategory(alert.category)),
+		fmt.Sprintf("SIMURGH_SQUAWK=%s", formatSquawk(alert.squawk)),
+		fmt.Sprintf("SIMURGH_TIME=%s", alert.time.UTC().Format(time.RFC3339)))
+
+	// don't hold up decoding while the hook runs
+	go func() {
+		if err := cmd.Run(); err != nil {
+			fmt.Fprintf(os.Stderr, "alert hook %s: %v\n", sink.command, err)
+		}
+	}()
+}
+
+func setupAlertSinks() error {
+	if *alertStderr {
+		alertSinks = append(alertSinks, &writerAlertSink{w: os.Stderr})
+	}
+	if *alertLog != "" {
+		f, err := os.OpenFile(*alertLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		alertSinks = append(alertSinks, &writerAlertSink{w: f})
+	}
+	if *alertExec != "" {
+		alertSinks = append(alertSinks, &execAlertSink{command: *alertExec})
+	}
+	return nil
+}
+
+// currentAlerts returns the alert conditions the aircraft is in right now.
+func currentAlerts(aircraft *aircraftData) alertKind {
+	var kinds alertKind
+
+	switch aircraft.squawk {
+	case 0x7500:
+		kinds |= alertHijack
+	case 0x7600:
+		kinds |= alertRadioFailure
+	case 0x7700:
+		kinds |= alertEmergency
+	}
+	if aircraft.emergencyState != 0 {
+		kinds |= alertESEmergency
+	}
+	if aircraft.fsAlert {
+		kinds |= alertFlightStatus
+	}
+	if aircraft.fsSPI {
+		kinds |= alertSPI
+	}
+
+	return kinds
+}
+
+// checkAlerts fires any alert the aircraft has newly entered, and retires
+// alerts whose condition has been gone for alertClearAfter.
+func checkAlerts(aircraft *aircraftData) {
+	now := time.Now()
+	current := currentAlerts(aircraft)
+
+	for i := uint(0); i < alertKindCount; i++ {
+		kind := alertKind(1 << i)
+
+		if current&kind != 0 {
+			aircraft.alertLastSeen[i] = now
+			if aircraft.activeAlerts&kind == 0 {
+				aircraft.activeAlerts |= kind
+				fireAlert(aircraft, kind)
+			}
+		} else if aircraft.activeAlerts&kind != 0 &&
+			now.Sub(aircraft.alertLastSeen[i]) > alertClearAfter {
+			aircraft.activeAlerts &^= kind
+		}
+	}
+}
+
+func fireAlert(aircraft *aircraftData, kind alertKind) {
+	alert := &alertEvent{
+		time:     time.Now(),
+		icaoAddr: aircraft.icaoAddr,
+		callsign: aircraft.callsign,
+		category: aircraft.category,
+		squawk:   aircraft.squawk,
+		kind:     kind,
+	}
+	if kind == alertESEmergency && aircraft.emergencyState < uint(len(esEmergencyStates)) {
+		alert.detail = esEmergencyStates[aircraft.emergencyState]
+	}
+
+	for _, sink := range alertSinks {
+		sink.deliver(alert)
+	}
+}
@@ -0,0 +1,117 @@
+// This file is part of Simurgh.
+// Copyright © 2016 Mike Tigas. All rights reserved.
+// This file is licensed under the terms of the GNU Affero General
+// Public License, version 3 or later. See the LICENSE.md file.
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"strings"
+)
+
+// AVR text framing, as on dump1090's port 30002. One frame per line:
+//
+//	*<hex>;                                  no timestamp
+//	@<12 hex timestamp><hex>;                12MHz timestamp
+//	%<12 hex timestamp><2 hex signal><hex>;  timestamp and signal level
+//
+// "<" is also accepted for the last form, which is what some dump1090 forks
+// send. The hex is 2 bytes for Mode A/C, 7 or 14 for Mode S. Frames are
+// turned into beastFrames so both formats are handled the same way.
+const (
+	avrFrameStart         = '*'
+	avrFrameWithTimestamp = '@'
+	avrFrameWithSignal    = '%'
+	avrFrameWithSignalAlt = '<'
+	avrFrameEnd           = ';'
+	avrTimestampHexLen    = beastTimestampLen * 2
+	avrSignalHexLen       = 2
+	avrMaxLineLen         = 64
+)
+
+type avrReader struct {
+	reader *bufio.Reader
+
+	// in the middle of a line too long to be a frame
+	overflowed bool
+}
+
+// readFrame returns the next valid frame in the stream; lines that don't
+// parse are skipped. A line that fills the read buffer without a ';' (a
+// BEAST stream taken for AVR, say) is dropped up to the next ';', rather
+// than read into memory.
+func (a *avrReader) readFrame() (*beastFrame, error) {
+	for {
+		line, err := a.reader.ReadSlice(avrFrameEnd)
+		if err == bufio.ErrBufferFull {
+			a.overflowed = true
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if a.overflowed {
+			a.overflowed = false
+			continue
+		}
+		if frame := parseAVRLine(string(line)); frame != nil {
+			return frame, nil
+		}
+	}
+}
+
+// parseAVRLine decodes one frame, with or without the trailing ';', or
+// returns nil if it isn't valid.
+func parseAVRLine(line string) *beastFrame {
+	line = strings.TrimSpace(line)
+	line = strings.TrimSuffix(line, string(avrFrameEnd))
+	if len(line) == 0 || len(line) > avrMaxLineLen {
+		return nil
+	}
+
+	frame := &beastFrame{timestamp: make([]byte, beastTimestampLen)}
+	body := line[1:]
+
+	switch line[0] {
+	case avrFrameStart:
+	case avrFrameWithTimestamp, avrFrameWithSignal, avrFrameWithSignalAlt:
+		if len(body) < avrTimestampHexLen {
+			return nil
+		}
+		if _, err := hex.Decode(frame.timestamp, []byte(body[:avrTimestampHexLen])); err != nil {
+			return nil
+		}
+		body = body[avrTimestampHexLen:]
+
+		if line[0] != avrFrameWithTimestamp {
+			if len(body) < avrSignalHexLen {
+				return nil
+			}
+			signal, err := hex.DecodeString(body[:avrSignalHexLen])
+			if err != nil {
+				return nil
+			}
+			frame.signal = signal[0]
+			body = body[avrSignalHexLen:]
+		}
+	default:
+		return nil
+	}
+
+	payload, err := hex.DecodeString(body)
+	if err != nil {
+		return nil
+	}
+	switch len(payload) {
+	case 2:
+		frame.frameType = beastFrameModeAC
+	case 7:
+		frame.frameType = beastFrameModeSShort
+	case 14:
+		frame.frameType = beastFrameModeSLong
+	default:
+		return nil
+	}
+	frame.payload = payload
+	return frame
+}
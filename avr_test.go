@@ -0,0 +1,87 @@
+// This file is part of Simurgh.
+// Copyright © 2016 Mike Tigas. All rights reserved.
+// This file is licensed under the terms of the GNU Affero General
+// Public License, version 3 or later. See the LICENSE.md file.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestParseAVRLine(t *testing.T) {
+	noTimestamp := make([]byte, beastTimestampLen)
+	timestamp := mustHex("0123456789ab")
+	long := mustHex("8d4840d6202cc371c32ce0576098")
+	short := mustHex("5d4840d6f8740f")
+
+	tests := []struct {
+		name string
+		line string
+		want *beastFrame // nil if the line should be dropped
+	}{
+		{"long", "*8d4840d6202cc371c32ce0576098;\n",
+			&beastFrame{beastFrameModeSLong, noTimestamp, 0, long}},
+		{"short", "*5d4840d6f8740f;",
+			&beastFrame{beastFrameModeSShort, noTimestamp, 0, short}},
+		{"mode A/C", "*2108;",
+			&beastFrame{beastFrameModeAC, noTimestamp, 0, []byte{0x21, 0x08}}},
+		{"no ';'", "*5d4840d6f8740f",
+			&beastFrame{beastFrameModeSShort, noTimestamp, 0, short}},
+		{"upper case", "*5D4840D6F8740F;",
+			&beastFrame{beastFrameModeSShort, noTimestamp, 0, short}},
+		{"timestamp", "@0123456789ab8d4840d6202cc371c32ce0576098;",
+			&beastFrame{beastFrameModeSLong, timestamp, 0, long}},
+		{"timestamp and signal", "%0123456789abc05d4840d6f8740f;",
+			&beastFrame{beastFrameModeSShort, timestamp, 0xc0, short}},
+		{"timestamp and signal, '<'", "<0123456789ab405d4840d6f8740f;\r\n",
+			&beastFrame{beastFrameModeSShort, timestamp, 0x40, short}},
+
+		{"empty", ";", nil},
+		{"unknown start", "#5d4840d6f8740f;", nil},
+		{"odd length", "*5d4840d6f8740;", nil},
+		{"bad hex", "*5d4840d6f874zz;", nil},
+		{"wrong length", "*5d4840d6f8740f00;", nil},
+		{"short timestamp", "@0123456789;", nil},
+		{"bad timestamp", "@0123456789xx5d4840d6f8740f;", nil},
+		{"no signal", "%0123456789ab;", nil},
+		{"bad signal", "%0123456789abxx5d4840d6f8740f;", nil},
+		{"too long", "*" + strings.Repeat("00", avrMaxLineLen) + ";", nil},
+	}
+	for _, test := range tests {
+		got := parseAVRLine(test.line)
+		switch {
+		case got == nil && test.want == nil:
+		case got == nil || test.want == nil:
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		case got.frameType != test.want.frameType || !bytes.Equal(got.timestamp, test.want.timestamp) ||
+			got.signal != test.want.signal || !bytes.Equal(got.payload, test.want.payload):
+			t.Errorf("%s: got %c %x %02x %x, want %c %x %02x %x", test.name,
+				got.frameType, got.timestamp, got.signal, got.payload,
+				test.want.frameType, test.want.timestamp, test.want.signal, test.want.payload)
+		}
+	}
+}
+
+// A stream that never sends a ';' mustn't be read into memory; the reader
+// drops the overlong line and picks up again after the next ';'.
+func TestAVRReaderResync(t *testing.T) {
+	input := strings.Repeat("\x1a3", 10000) + ";\n*5d4840d6f8740f;\n*2108;\n"
+	reader := &avrReader{reader: bufio.NewReaderSize(strings.NewReader(input), 64)}
+
+	for _, want := range []byte{beastFrameModeSShort, beastFrameModeAC} {
+		frame, err := reader.readFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame.frameType != want {
+			t.Errorf("got frame type %c, want %c", frame.frameType, want)
+		}
+	}
+	if _, err := reader.readFrame(); err != io.EOF {
+		t.Errorf("got %v at the end, want EOF", err)
+	}
+}
@@ -0,0 +1,162 @@
+// This file is part of Simurgh.
+// Copyright © 2016 Mike Tigas. All rights reserved.
+// This file is licensed under the terms of the GNU Affero General
+// Public License, version 3 or later. See the LICENSE.md file.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// BEAST binary framing
+// http://wiki.modesbeast.com/Mode-S_Beast:Data_Output_Formats
+//
+// Every frame is <0x1A> <type> <6 byte timestamp> <1 byte signal> <payload>.
+// Any 0x1A byte inside the timestamp, signal or payload is sent twice, so a
+// lone 0x1A is always the start of a new frame.
+const (
+	beastEscape = 0x1A
+
+	beastFrameModeAC     = byte('1')
+	beastFrameModeSShort = byte('2')
+	beastFrameModeSLong  = byte('3')
+	beastFrameStatus     = byte('4')
+
+	beastTimestampLen = 6
+)
+
+var magicTimestampMLAT = []byte{0xFF, 0x00, 0x4D, 0x4C, 0x41, 0x54}
+
+type beastFrame struct {
+	frameType byte
+	timestamp []byte
+	signal    byte
+	payload   []byte
+}
+
+// isMlat reports whether the frame was synthesized by mlat-client, which
+// marks its output with a fixed "MLAT" timestamp.
+func (f *beastFrame) isMlat() bool {
+	return bytes.Equal(f.timestamp, magicTimestampMLAT)
+}
+
+// beastPayloadLen returns the payload length for a frame type, or -1 if the
+// type byte isn't one we know.
+func beastPayloadLen(frameType byte) int {
+	switch frameType {
+	case beastFrameModeAC:
+		return 2
+	case beastFrameModeSShort:
+		return 7
+	case beastFrameModeSLong:
+		return 14
+	case beastFrameStatus:
+		// Radarcape status frames are the same size as a long Mode-S frame
+		return 14
+	}
+	return -1
+}
+
+type beastReader struct {
+	reader *bufio.Reader
+
+	// true when the last byte consumed was a lone 0x1A, i.e. the next byte
+	// is a frame type byte
+	atFrameStart bool
+}
+
+func newBeastReader(r io.Reader) *beastReader {
+	return &beastReader{reader: bufio.NewReader(r)}
+}
+
+// readFrame returns the next complete frame in the stream. Garbage, unknown
+// frame types and truncated frames are skipped; the only errors returned are
+// from the underlying reader.
+func (b *beastReader) readFrame() (*beastFrame, error) {
+	for {
+		frameType, err := b.nextFrameType()
+		if err != nil {
+			return nil, err
+		}
+
+		payloadLen := beastPayloadLen(frameType)
+		if payloadLen < 0 {
+			continue
+		}
+
+		body, err := b.readEscaped(beastTimestampLen + 1 + payloadLen)
+		if err != nil {
+			return nil, err
+		}
+		if body == nil {
+			// truncated by the start of another frame
+			continue
+		}
+
+		return &beastFrame{
+			frameType: frameType,
+			timestamp: body[:beastTimestampLen],
+			signal:    body[beastTimestampLen],
+			payload:   body[beastTimestampLen+1:],
+		}, nil
+	}
+}
+
+// nextFrameType skips ahead to the next lone 0x1A and returns the type byte
+// following it.
+func (b *beastReader) nextFrameType() (byte, error) {
+	for {
+		if !b.atFrameStart {
+			if err := b.skipToEscape(); err != nil {
+				return 0, err
+			}
+		}
+		b.atFrameStart = false
+
+		c, err := b.reader.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if c == beastEscape {
+			// escaped 0x1A in the middle of data we're not synced to
+			continue
+		}
+		return c, nil
+	}
+}
+
+func (b *beastReader) skipToEscape() error {
+	for {
+		_, err := b.reader.ReadSlice(beastEscape)
+		if err != bufio.ErrBufferFull {
+			return err
+		}
+	}
+}
+
+// readEscaped reads n unescaped bytes. If a lone 0x1A shows up first, the
+// reader is left at the start of that frame and nil is returned.
+func (b *beastReader) readEscaped(n int) ([]byte, error) {
+	buf := make([]byte, 0, n)
+	for len(buf) < n {
+		c, err := b.reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if c == beastEscape {
+			next, err := b.reader.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			if next != beastEscape {
+				b.reader.UnreadByte()
+				b.atFrameStart = true
+				return nil, nil
+			}
+		}
+		buf = append(buf, c)
+	}
+	return buf, nil
+}
@@ -0,0 +1,162 @@
+// This file is part of Simurgh.
+// Copyright © 2016 Mike Tigas. All rights reserved.
+// This file is licensed under the terms of the GNU Affero General
+// Public License, version 3 or later. See the LICENSE.md file.
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"testing"
+)
+
+// beastEncode frames a message the way a receiver would, doubling any 0x1A.
+func beastEncode(frameType byte, timestamp []byte, signal byte, payload []byte) []byte {
+	out := []byte{beastEscape, frameType}
+	body := append(append(append([]byte{}, timestamp...), signal), payload...)
+	for _, c := range body {
+		if c == beastEscape {
+			out = append(out, beastEscape)
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestBeastReader(t *testing.T) {
+	timestamp := []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06}
+	escapedTimestamp := []byte{0x00, 0x1A, 0x02, 0x03, 0x1A, 0x05}
+	modeAC := []byte{0x21, 0x08}
+	short := mustHex("5d4840d6db1a2a")
+	long := mustHex("8d4840d6202cc371c32ce0576098")
+	status := mustHex("00112233445566778899aabbccdd")
+
+	frame := func(frameType byte, timestamp []byte, signal byte, payload []byte) beastFrame {
+		return beastFrame{frameType: frameType, timestamp: timestamp, signal: signal, payload: payload}
+	}
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+
+	tests := []struct {
+		name  string
+		input []byte
+		want  []beastFrame
+	}{
+		{
+			name:  "mode A/C",
+			input: beastEncode(beastFrameModeAC, timestamp, 0x40, modeAC),
+			want:  []beastFrame{frame(beastFrameModeAC, timestamp, 0x40, modeAC)},
+		},
+		{
+			name:  "short mode S",
+			input: beastEncode(beastFrameModeSShort, timestamp, 0x40, short),
+			want:  []beastFrame{frame(beastFrameModeSShort, timestamp, 0x40, short)},
+		},
+		{
+			name:  "long mode S",
+			input: beastEncode(beastFrameModeSLong, timestamp, 0x40, long),
+			want:  []beastFrame{frame(beastFrameModeSLong, timestamp, 0x40, long)},
+		},
+		{
+			name:  "status",
+			input: beastEncode(beastFrameStatus, timestamp, 0x40, status),
+			want:  []beastFrame{frame(beastFrameStatus, timestamp, 0x40, status)},
+		},
+		{
+			name:  "escaped timestamp",
+			input: beastEncode(beastFrameModeSLong, escapedTimestamp, 0x40, long),
+			want:  []beastFrame{frame(beastFrameModeSLong, escapedTimestamp, 0x40, long)},
+		},
+		{
+			name:  "escaped signal",
+			input: beastEncode(beastFrameModeSLong, timestamp, beastEscape, long),
+			want:  []beastFrame{frame(beastFrameModeSLong, timestamp, beastEscape, long)},
+		},
+		{
+			name:  "escaped payload",
+			input: beastEncode(beastFrameModeSShort, timestamp, 0x40, short),
+			want:  []beastFrame{frame(beastFrameModeSShort, timestamp, 0x40, short)},
+		},
+		{
+			name:  "escaped payload ending in 0x1a",
+			input: beastEncode(beastFrameModeAC, timestamp, 0x40, []byte{0x21, beastEscape}),
+			want:  []beastFrame{frame(beastFrameModeAC, timestamp, 0x40, []byte{0x21, beastEscape})},
+		},
+		{
+			name: "truncated frame",
+			input: join(
+				beastEncode(beastFrameModeSShort, timestamp, 0x40, short)[:9],
+				beastEncode(beastFrameModeSLong, timestamp, 0x40, long),
+			),
+			want: []beastFrame{frame(beastFrameModeSLong, timestamp, 0x40, long)},
+		},
+		{
+			name: "unknown type",
+			input: join(
+				[]byte{beastEscape, '9', 0x01, 0x02},
+				beastEncode(beastFrameModeAC, timestamp, 0x40, modeAC),
+			),
+			want: []beastFrame{frame(beastFrameModeAC, timestamp, 0x40, modeAC)},
+		},
+		{
+			name: "leading garbage",
+			input: join(
+				[]byte{0x00, 0x55, beastEscape, beastEscape, '3', 0x7F},
+				beastEncode(beastFrameModeSLong, timestamp, 0x40, long),
+			),
+			want: []beastFrame{frame(beastFrameModeSLong, timestamp, 0x40, long)},
+		},
+		{
+			name: "back to back",
+			input: join(
+				beastEncode(beastFrameModeSShort, timestamp, 0x40, short),
+				beastEncode(beastFrameModeSLong, magicTimestampMLAT, 0xFF, long),
+			),
+			want: []beastFrame{
+				frame(beastFrameModeSShort, timestamp, 0x40, short),
+				frame(beastFrameModeSLong, magicTimestampMLAT, 0xFF, long),
+			},
+		},
+		{
+			name:  "empty",
+			input: nil,
+		},
+	}
+
+	for _, test := range tests {
+		reader := newBeastReader(bytes.NewReader(test.input))
+		for i, want := range test.want {
+			got, err := reader.readFrame()
+			if err != nil {
+				t.Errorf("%s: frame %d: %v", test.name, i, err)
+				break
+			}
+			if got.frameType != want.frameType || !bytes.Equal(got.timestamp, want.timestamp) ||
+				got.signal != want.signal || !bytes.Equal(got.payload, want.payload) {
+				t.Errorf("%s: frame %d: got %c %x %02x %x, want %c %x %02x %x", test.name, i,
+					got.frameType, got.timestamp, got.signal, got.payload,
+					want.frameType, want.timestamp, want.signal, want.payload)
+			}
+		}
+		if _, err := reader.readFrame(); err != io.EOF {
+			t.Errorf("%s: got %v at the end, want EOF", test.name, err)
+		}
+	}
+}
+
+func TestBeastFrameIsMlat(t *testing.T) {
+	if !(&beastFrame{timestamp: magicTimestampMLAT}).isMlat() {
+		t.Error("MLAT timestamp not recognized")
+	}
+	if (&beastFrame{timestamp: []byte{0xFF, 0x00, 0x4D, 0x4C, 0x41, 0x55}}).isMlat() {
+		t.Error("ordinary timestamp taken for MLAT")
+	}
+}
@@ -0,0 +1,492 @@
+// This file is part of Simurgh.
+// Copyright © 2016 Mike Tigas. All rights reserved.
+// This file is licensed under the terms of the GNU Affero General
+// Public License, version 3 or later. See the LICENSE.md file.
+//
+// The register inference here follows the approach of dump1090-fa's
+// comm_b.c <https://github.com/flightaware/dump1090> and pyModeS
+// <https://github.com/junzis/pyModeS>.
+package main
+
+import (
+	"math"
+	"strings"
+	"time"
+)
+
+// A Comm-B reply (DF20/21) carries a 56 bit MB field holding one of the
+// aircraft's BDS registers, but nothing in the reply says which: that was
+// decided by the interrogation, which we don't hear. So we try every
+// register we know and keep the one that fits best.
+//
+// A candidate's score is the number of MB bits that matched what the
+// register expects: fixed header bits, reserved bits that must be zero, and
+// fields whose status bit is set and whose value is plausible. Fields that
+// agree with what we already know about the aircraft score a bonus, and ones
+// that clearly disagree rule the register out.
+type commBCandidate struct {
+	bds   uint // e.g. 0x40 for BDS 4,0
+	score int
+	apply func(aircraft *aircraftData)
+}
+
+const commBAgreementBonus = 8
+
+var commBDecoders = []func(message []byte, aircraft *aircraftData) *commBCandidate{
+	decodeBDS10,
+	decodeBDS17,
+	decodeBDS20,
+	decodeBDS30,
+	decodeBDS40,
+	decodeBDS50,
+	decodeBDS60,
+}
+
+// bits in the BDS 1,7 GICB capability report, for the registers we decode
+// that it covers
+var gicbCapabilityBits = map[uint]int{
+	0x20: 7,
+	0x40: 9,
+	0x50: 16,
+	0x60: 24,
+}
+
+// decodeCommB infers the register in a DF20/21 MB field and merges it into
+// the aircraft. Replies that fit more than one register equally well are
+// counted and dropped.
+func decodeCommB(message []byte, aircraft *aircraftData) {
+	if mbBits(message, 1, 28) == 0 && mbBits(message, 29, 56) == 0 {
+		return // nothing there
+	}
+
+	var best *commBCandidate
+	ambiguous := false
+
+	for _, decoder := range commBDecoders {
+		candidate := decoder(message, aircraft)
+		if candidate == nil || !gicbAllows(aircraft, candidate.bds) {
+			continue
+		}
+		if best == nil || candidate.score > best.score {
+			best = candidate
+			ambiguous = false
+		} else if candidate.score == best.score {
+			ambiguous = true
+		}
+	}
+
+	if best == nil {
+		return
+	}
+	if ambiguous {
+		modesStats.countCommBAmbiguous()
+		return
+	}
+	modesStats.countCommB(best.bds)
+	best.apply(aircraft)
+}
+
+// mbBits is getBits with the numbering of the MB field, bit 1 being message
+// bit 33.
+func mbBits(message []byte, first, last int) uint {
+	return getBits(message, first+32, last+32)
+}
+
+// mbSigned reads a sign bit followed by a two's complement value.
+func mbSigned(message []byte, signBit, first, last int) int {
+	value := int(mbBits(message, first, last))
+	if mbBits(message, signBit, signBit) == 1 {
+		value -= 1 << uint(last-first+1)
+	}
+	return value
+}
+
+// mbStatusField checks a status bit and the value bits it covers (from the
+// status bit up to last). A field with its status clear must be all zeros.
+func mbStatusField(message []byte, status, last int) (present, valid bool) {
+	if mbBits(message, status, status) == 1 {
+		return true, true
+	}
+	return false, mbBits(message, status+1, last) == 0
+}
+
+// gicbAllows rules out registers the aircraft told us it doesn't have.
+func gicbAllows(aircraft *aircraftData, bds uint) bool {
+	bit, covered := gicbCapabilityBits[bds]
+	if !covered || aircraft.gicbCapability == 0 {
+		return true
+	}
+	return aircraft.gicbCapability&(1<<uint(24-bit)) != 0
+}
+
+// commBFills reports whether Comm-B values should replace the ones that
+// extended squitters also carry.
+func commBFills(aircraft *aircraftData) bool {
+	return time.Since(aircraft.lastES) > commBMergeAge
+}
+
+// recent reports whether a value stamped t is fresh enough to check a
+// Comm-B reply against.
+func recent(t time.Time) bool {
+	return time.Since(t) <= commBMergeAge
+}
+
+// BDS 1,0: data link capability report
+func decodeBDS10(message []byte, aircraft *aircraftData) *commBCandidate {
+	if mbBits(message, 1, 8) != 0x10 || mbBits(message, 10, 14) != 0 {
+		return nil
+	}
+	// subnetwork versions run 0-5 so far
+	version := mbBits(message, 17, 23)
+	if version > 5 {
+		return nil
+	}
+	squitterCapable := mbBits(message, 34, 34) == 1
+	raCapable := mbBits(message, 38, 38) == 1
+
+	return &commBCandidate{bds: 0x10, score: 8 + 5 + 4,
+		apply: func(aircraft *aircraftData) {
+			aircraft.modeSSubnetVersion = version
+			aircraft.squitterCapable = squitterCapable
+			aircraft.acasRACapable = raCapable
+			aircraft.lastDataLinkCapability = time.Now()
+		}}
+}
+
+// BDS 1,7: common usage GICB capability report, a bit per register
+func decodeBDS17(message []byte, aircraft *aircraftData) *commBCandidate {
+	// everyone has BDS 2,0, and bits 25-56 are reserved
+	if mbBits(message, 7, 7) != 1 ||
+		mbBits(message, 25, 40) != 0 || mbBits(message, 41, 56) != 0 {
+		return nil
+	}
+	capability := mbBits(message, 1, 24)
+
+	return &commBCandidate{bds: 0x17, score: 1 + 32,
+		apply: func(aircraft *aircraftData) {
+			aircraft.gicbCapability = capability
+		}}
+}
+
+// BDS 2,0: aircraft identification, in the same charset as ES type 1-4
+func decodeBDS20(message []byte, aircraft *aircraftData) *commBCandidate {
+	if mbBits(message, 1, 8) != 0x20 {
+		return nil
+	}
+	var chars [8]byte
+	for i := range chars {
+		c := mbBits(message, 9+i*6, 14+i*6)
+		// letters, digits and space only
+		if !(c >= 1 && c <= 26) && !(c >= 48 && c <= 57) && c != 32 {
+			return nil
+		}
+		chars[i] = aisCharset[c]
+	}
+	callsign := string(chars[:])
+	if strings.TrimSpace(callsign) == "" {
+		return nil
+	}
+
+	score := 8 + 48
+	if callsign == aircraft.callsign {
+		score += commBAgreementBonus
+	}
+	return &commBCandidate{bds: 0x20, score: score,
+		apply: func(aircraft *aircraftData) {
+			if aircraft.callsign == "" || commBFills(aircraft) {
+				aircraft.callsign = callsign
+			}
+		}}
+}
+
+// BDS 3,0: ACAS active resolution advisory; see acas.go
+func decodeBDS30(message []byte, aircraft *aircraftData) *commBCandidate {
+	if mbBits(message, 1, 8) != 0x30 {
+		return nil
+	}
+	ra, ok := decodeResolutionAdvisory(message)
+	if !ok {
+		return nil
+	}
+
+	return &commBCandidate{bds: 0x30, score: 8 + 2,
+		apply: func(aircraft *aircraftData) {
+			aircraft.setRA(ra, "BDS 3,0")
+		}}
+}
+
+// BDS 4,0: selected vertical intention
+func decodeBDS40(message []byte, aircraft *aircraftData) *commBCandidate {
+	if mbBits(message, 40, 47) != 0 || mbBits(message, 52, 53) != 0 {
+		return nil
+	}
+	score := 8 + 2
+
+	mcpPresent, mcpValid := mbStatusField(message, 1, 13)
+	fmsPresent, fmsValid := mbStatusField(message, 14, 26)
+	baroPresent, baroValid := mbStatusField(message, 27, 39)
+	modesPresent, modesValid := mbStatusField(message, 48, 51)
+	sourcePresent, sourceValid := mbStatusField(message, 54, 56)
+	if !mcpValid || !fmsValid || !baroValid || !modesValid || !sourceValid ||
+		!(mcpPresent || fmsPresent || baroPresent) {
+		return nil
+	}
+
+	mcpAltitude := int32(mbBits(message, 2, 13)) * 16
+	fmsAltitude := int32(mbBits(message, 15, 26)) * 16
+	baro := 800.0 + float64(mbBits(message, 28, 39))*0.1
+
+	if mcpPresent {
+		if mcpAltitude <= 0 || mcpAltitude > 50000 {
+			return nil
+		}
+		score += 13
+	}
+	if fmsPresent {
+		if fmsAltitude <= 0 || fmsAltitude > 50000 {
+			return nil
+		}
+		score += 13
+	}
+	if baroPresent {
+		if baro < 900 || baro > 1100 {
+			return nil
+		}
+		score += 13
+	}
+	if modesPresent {
+		score += 4
+	}
+	if sourcePresent {
+		score += 3
+	}
+
+	if mcpPresent && recent(aircraft.lastSelectedAltitude) &&
+		!aircraft.selectedAltitudeFMS {
+		if diff := mcpAltitude - aircraft.selectedAltitude; diff > 50 || diff < -50 {
+			return nil
+		}
+		score += commBAgreementBonus
+	}
+
+	var modes navMode
+	if mbBits(message, 49, 49) == 1 {
+		modes |= navModeVNAV
+	}
+	if mbBits(message, 50, 50) == 1 {
+		modes |= navModeAltHold
+	}
+	if mbBits(message, 51, 51) == 1 {
+		modes |= navModeApproach
+	}
+
+	return &commBCandidate{bds: 0x40, score: score,
+		apply: func(aircraft *aircraftData) {
+			if !commBFills(aircraft) {
+				return
+			}
+			now := time.Now()
+			// the MCP/FCU altitude is what the crew dialled in, so prefer it
+			if mcpPresent {
+				aircraft.selectedAltitude = mcpAltitude
+				aircraft.selectedAltitudeFMS = false
+				aircraft.lastSelectedAltitude = now
+			} else if fmsPresent {
+				aircraft.selectedAltitude = fmsAltitude
+				aircraft.selectedAltitudeFMS = true
+				aircraft.lastSelectedAltitude = now
+			}
+			if baroPresent {
+				aircraft.baroSetting = baro
+				aircraft.lastBaroSetting = now
+			}
+			if modesPresent {
+				const commBModes = navModeVNAV | navModeAltHold | navModeApproach
+				aircraft.navModes = aircraft.navModes&^commBModes | modes
+				aircraft.lastNavModes = now
+			}
+		}}
+}
+
+// BDS 5,0: track and turn report
+func decodeBDS50(message []byte, aircraft *aircraftData) *commBCandidate {
+	rollPresent, rollValid := mbStatusField(message, 1, 11)
+	trackPresent, trackValid := mbStatusField(message, 12, 23)
+	gsPresent, gsValid := mbStatusField(message, 24, 34)
+	ratePresent, rateValid := mbStatusField(message, 35, 45)
+	tasPresent, tasValid := mbStatusField(message, 46, 56)
+	if !rollValid || !trackValid || !gsValid || !rateValid || !tasValid ||
+		!(rollPresent || trackPresent || gsPresent || ratePresent || tasPresent) {
+		return nil
+	}
+	score := 0
+
+	roll := float64(mbSigned(message, 2, 3, 11)) * 45.0 / 256.0
+	track := cprModFloat(float64(mbSigned(message, 13, 14, 23))*90.0/512.0, 360)
+	groundSpeed := float64(mbBits(message, 25, 34)) * 2
+	trackRate := float64(mbSigned(message, 36, 37, 45)) * 8.0 / 256.0
+	tas := float64(mbBits(message, 47, 56)) * 2
+
+	if rollPresent {
+		if math.Abs(roll) > 50 {
+			return nil
+		}
+		score += 11
+	}
+	if trackPresent {
+		if recent(aircraft.lastTrack) {
+			if angleDifference(track, aircraft.track) > 90 {
+				return nil
+			}
+			score += commBAgreementBonus
+		}
+		score += 12
+	}
+	if gsPresent {
+		if groundSpeed == 0 || groundSpeed > 600 {
+			return nil
+		}
+		if recent(aircraft.lastGroundSpeed) {
+			if math.Abs(groundSpeed-aircraft.groundSpeed) > 50 {
+				return nil
+			}
+			score += commBAgreementBonus
+		}
+		score += 11
+	}
+	if ratePresent {
+		score += 11
+	}
+	if tasPresent {
+		if tas == 0 || tas > 500 {
+			return nil
+		}
+		score += 11
+	}
+	if gsPresent && tasPresent && math.Abs(groundSpeed-tas) > 200 {
+		return nil
+	}
+
+	return &commBCandidate{bds: 0x50, score: score,
+		apply: func(aircraft *aircraftData) {
+			now := time.Now()
+			if rollPresent {
+				aircraft.roll = roll
+				aircraft.lastRoll = now
+			}
+			if ratePresent {
+				aircraft.trackRate = trackRate
+				aircraft.lastTrackRate = now
+			}
+			if !commBFills(aircraft) {
+				return
+			}
+			if trackPresent {
+				aircraft.track = track
+				aircraft.lastTrack = now
+			}
+			if gsPresent {
+				aircraft.groundSpeed = groundSpeed
+				aircraft.lastGroundSpeed = now
+			}
+			if tasPresent {
+				aircraft.airspeed = tas
+				aircraft.airspeedIsTrue = true
+				aircraft.lastAirspeed = now
+			}
+		}}
+}
+
+// BDS 6,0: heading and speed report
+func decodeBDS60(message []byte, aircraft *aircraftData) *commBCandidate {
+	headingPresent, headingValid := mbStatusField(message, 1, 12)
+	iasPresent, iasValid := mbStatusField(message, 13, 23)
+	machPresent, machValid := mbStatusField(message, 24, 34)
+	baroRatePresent, baroRateValid := mbStatusField(message, 35, 45)
+	inertialPresent, inertialValid := mbStatusField(message, 46, 56)
+	if !headingValid || !iasValid || !machValid || !baroRateValid || !inertialValid ||
+		!(headingPresent || iasPresent || machPresent || baroRatePresent || inertialPresent) {
+		return nil
+	}
+	score := 0
+
+	heading := cprModFloat(float64(mbSigned(message, 2, 3, 12))*90.0/512.0, 360)
+	ias := float64(mbBits(message, 14, 23))
+	mach := float64(mbBits(message, 25, 34)) * 2.048 / 512.0
+	baroRate := int32(mbSigned(message, 36, 37, 45)) * 32
+	inertialRate := int32(mbSigned(message, 47, 48, 56)) * 32
+
+	if headingPresent {
+		// heading is magnetic and track is true, and there's wind, so
+		// only a loose check
+		if recent(aircraft.lastTrack) && !aircraft.onGround {
+			if angleDifference(heading, aircraft.track) > 45 {
+				return nil
+			}
+			score += commBAgreementBonus
+		}
+		score += 12
+	}
+	if iasPresent {
+		if ias == 0 || ias > 500 {
+			return nil
+		}
+		score += 11
+	}
+	if machPresent {
+		if mach == 0 || mach > 1 {
+			return nil
+		}
+		score += 11
+	}
+	if iasPresent && machPresent {
+		// IAS is at most the TAS, which is about 661 knots at mach 1 at sea
+		// level and less higher up
+		if ias > mach*661.5+20 {
+			return nil
+		}
+	}
+	if baroRatePresent {
+		if baroRate > 6000 || baroRate < -6000 {
+			return nil
+		}
+		score += 11
+	}
+	if inertialPresent {
+		if inertialRate > 6000 || inertialRate < -6000 {
+			return nil
+		}
+		score += 11
+	}
+	if baroRatePresent && inertialPresent {
+		if diff := baroRate - inertialRate; diff > 2000 || diff < -2000 {
+			return nil
+		}
+	}
+
+	return &commBCandidate{bds: 0x60, score: score,
+		apply: func(aircraft *aircraftData) {
+			now := time.Now()
+			if machPresent {
+				aircraft.mach = mach
+				aircraft.lastMach = now
+			}
+			if !commBFills(aircraft) {
+				return
+			}
+			if headingPresent {
+				aircraft.heading = heading
+				aircraft.lastHeading = now
+			}
+			if iasPresent {
+				aircraft.airspeed = ias
+				aircraft.airspeedIsTrue = false
+				aircraft.lastAirspeed = now
+			}
+			if baroRatePresent {
+				aircraft.verticalRate = baroRate
+				aircraft.verticalRateGNSS = false
+				aircraft.lastVerticalRate = now
+			}
+		}}
+}
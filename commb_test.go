@@ -0,0 +1,140 @@
+// This file is part of Simurgh.
+// Copyright © 2016 Mike Tigas. All rights reserved.
+// This file is licensed under the terms of the GNU Affero General
+// Public License, version 3 or later. See the LICENSE.md file.
+package main
+
+import (
+	"math"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// The MB fields are from pyModeS's test data, except where noted; values
+// are as pyModeS decodes them.
+func TestDecodeCommB(t *testing.T) {
+	roughly := func(got, want, tolerance float64) bool {
+		return math.Abs(got-want) <= tolerance
+	}
+
+	tests := []struct {
+		name    string
+		message string
+		bds     uint // 0 if the reply should be dropped as ambiguous
+		prepare func(aircraft *aircraftData)
+		check   func(aircraft *aircraftData) bool
+	}{
+		{
+			name:    "1,0 data link capability",
+			message: "a800178d10010080f50000d5893c",
+			bds:     0x10,
+			check: func(aircraft *aircraftData) bool {
+				return aircraft.modeSSubnetVersion == 0 && aircraft.squitterCapable &&
+					aircraft.acasRACapable && !aircraft.lastDataLinkCapability.IsZero()
+			},
+		},
+		{
+			name:    "1,7 GICB capability",
+			message: "a0000638fa81c10000000081a92f",
+			bds:     0x17,
+			check: func(aircraft *aircraftData) bool {
+				return aircraft.gicbCapability == 0xfa81c1
+			},
+		},
+		{
+			name:    "2,0 identification",
+			message: "a000083e202cc371c31de0aa1ccf",
+			bds:     0x20,
+			check: func(aircraft *aircraftData) bool {
+				return aircraft.callsign == "KLM1017 "
+			},
+		},
+		{
+			// made up: a climb against 4840d6
+			name:    "3,0 resolution advisory",
+			message: "a000183830c20005210358000000",
+			bds:     0x30,
+			check: func(aircraft *aircraftData) bool {
+				return aircraft.ra.ara == 1<<13|1<<12|1<<7 && aircraft.ra.tti == 1 &&
+					aircraft.ra.threatAddress() == 0x4840d6 && aircraft.raSource == "BDS 3,0"
+			},
+		},
+		{
+			name:    "4,0 selected vertical intention",
+			message: "a000029c85e42f313000007047d3",
+			bds:     0x40,
+			check: func(aircraft *aircraftData) bool {
+				return aircraft.selectedAltitude == 3008 && !aircraft.selectedAltitudeFMS &&
+					roughly(aircraft.baroSetting, 1020, 0.05)
+			},
+		},
+		{
+			name:    "5,0 track and turn",
+			message: "a000139381951536e024d4ccf6b5",
+			bds:     0x50,
+			check: func(aircraft *aircraftData) bool {
+				return roughly(aircraft.roll, 2.1, 0.05) &&
+					roughly(aircraft.track, 114.258, 0.001) &&
+					aircraft.groundSpeed == 438 &&
+					roughly(aircraft.trackRate, 0.125, 0.001) &&
+					aircraft.airspeed == 424 && aircraft.airspeedIsTrue
+			},
+		},
+		{
+			name:    "6,0 heading and speed",
+			message: "a00004128f39f91a7e27c46adc21",
+			bds:     0x60,
+			check: func(aircraft *aircraftData) bool {
+				return roughly(aircraft.heading, 42.715, 0.001) &&
+					aircraft.airspeed == 252 && !aircraft.airspeedIsTrue &&
+					roughly(aircraft.mach, 0.42, 0.001) &&
+					aircraft.verticalRate == -1920
+			},
+		},
+		{
+			// made up: every field present, and plausible either way
+			name:    "5,0 or 6,0",
+			message: "a00018388019f53225a4b4000000",
+			check: func(aircraft *aircraftData) bool {
+				return aircraft.lastTrack.IsZero() && aircraft.lastHeading.IsZero()
+			},
+		},
+		{
+			// the same, but the track 5,0 gives matches the one we have
+			name:    "5,0 or 6,0, known track",
+			message: "a00018388019f53225a4b4000000",
+			bds:     0x50,
+			prepare: func(aircraft *aircraftData) {
+				aircraft.track = 224
+				aircraft.lastTrack = time.Now()
+			},
+			check: func(aircraft *aircraftData) bool {
+				return roughly(aircraft.track, 223.945, 0.001) && aircraft.groundSpeed == 400 &&
+					aircraft.airspeed == 360 && aircraft.airspeedIsTrue
+			},
+		},
+	}
+
+	for _, test := range tests {
+		aircraft := newAircraftData(0x40621d)
+		if test.prepare != nil {
+			test.prepare(&aircraft)
+		}
+		ambiguous := atomic.LoadUint64(&modesStats.commBAmbiguous)
+		counted := atomic.LoadUint64(&modesStats.commB[test.bds])
+
+		decodeCommB(mustHex(test.message), &aircraft)
+
+		if test.bds == 0 {
+			if atomic.LoadUint64(&modesStats.commBAmbiguous) != ambiguous+1 {
+				t.Errorf("%s: not counted as ambiguous", test.name)
+			}
+		} else if atomic.LoadUint64(&modesStats.commB[test.bds]) != counted+1 {
+			t.Errorf("%s: not decoded as BDS %X,%X", test.name, test.bds>>4, test.bds&0xF)
+		}
+		if !test.check(&aircraft) {
+			t.Errorf("%s: wrong values decoded: %+v", test.name, aircraft)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+// This file is part of Simurgh.
+// Copyright © 2016 Mike Tigas. All rights reserved.
+// This file is licensed under the terms of the GNU Affero General
+// Public License, version 3 or later. See the LICENSE.md file.
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	upstreamDialTimeout = 10 * time.Second
+	// wait this long before the first reconnect, doubling each time up to
+	// the maximum
+	upstreamMinBackoff = 1 * time.Second
+	upstreamMaxBackoff = 60 * time.Second
+	// a connection that stayed up this long resets the backoff
+	upstreamStableAfter = 30 * time.Second
+)
+
+// stringList is a flag that can be given more than once
+type stringList []string
+
+func (list *stringList) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *stringList) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
+
+type upstreamState uint
+
+const (
+	upstreamConnecting = upstreamState(iota)
+	upstreamConnected
+	upstreamWaiting
+)
+
+// An upstream is a source we dial out to with -connect
+type upstream struct {
+	lock sync.Mutex
+
+	addr    string
+	state   upstreamState
+	since   time.Time // when state last changed
+	retryAt time.Time // when upstreamWaiting
+	lastErr error
+}
+
+// upstreams is every -connect source, for the status lines in the table
+var upstreams []*upstream
+
+func (source *upstream) setState(state upstreamState, err error) {
+	source.lock.Lock()
+	defer source.lock.Unlock()
+	source.state = state
+	source.since = time.Now()
+	if err != nil {
+		source.lastErr = err
+	}
+}
+
+// String describes the source's state for the table, e.g.
+// "127.0.0.1:30005 connected 2m3s".
+func (source *upstream) String() string {
+	source.lock.Lock()
+	defer source.lock.Unlock()
+
+	switch source.state {
+	case upstreamConnected:
+		return fmt.Sprintf("%s connected %s", source.addr,
+			time.Since(source.since).Truncate(time.Second))
+	case upstreamWaiting:
+		return fmt.Sprintf("%s reconnecting in %s (%v)", source.addr,
+			time.Until(source.retryAt).Round(time.Second), source.lastErr)
+	}
+	return fmt.Sprintf("%s connecting", source.addr)
+}
+
+// runUpstream keeps a connection to the source open for as long as the
+// program runs, decoding it like an inbound connection.
+func runUpstream(source *upstream, knownAircraft *aircraftMap, knownModeAC *modeACMap) {
+	backoff := upstreamMinBackoff
+
+	for {
+		source.setState(upstreamConnecting, nil)
+		conn, err := net.DialTimeout("tcp", source.addr, upstreamDialTimeout)
+
+		if err == nil {
+			source.setState(upstreamConnected, nil)
+			connected := time.Now()
+
+			err = handleConnection(conn, knownAircraft, knownModeAC)
+			if err == nil {
+				err = fmt.Errorf("connection closed")
+			}
+			if time.Since(connected) >= upstreamStableAfter {
+				backoff = upstreamMinBackoff
+			}
+		}
+
+		source.lock.Lock()
+		source.retryAt = time.Now().Add(backoff)
+		source.lock.Unlock()
+		source.setState(upstreamWaiting, err)
+
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > upstreamMaxBackoff {
+			backoff = upstreamMaxBackoff
+		}
+	}
+}
@@ -0,0 +1,191 @@
+// This file is part of Simurgh.
+// Copyright © 2016 Mike Tigas. All rights reserved.
+// This file is licensed under the terms of the GNU Affero General
+// Public License, version 3 or later. See the LICENSE.md file.
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+const cprTolerance = 0.00001 // degrees, about a meter
+
+func closeTo(got, want float64) bool {
+	return math.Abs(got-want) <= cprTolerance
+}
+
+// near is for positions we encoded ourselves: CPR resolution is about 5m
+// airborne, but in degrees of longitude that grows towards the poles.
+func near(lat, lon, wantLat, wantLon float64) bool {
+	return greatcircle(lat, lon, wantLat, wantLon) <= 10
+}
+
+// rawCPR pulls the CPR fields out of an airborne or surface position.
+func rawCPR(message []byte) (rawLat, rawLon uint32, odd bool) {
+	return uint32(getBits(message, 55, 71)), uint32(getBits(message, 72, 88)),
+		getBits(message, 54, 54) == 1
+}
+
+// encodeCPR is the CPR encoding from DO-260B, for positions the published
+// examples don't cover.
+func encodeCPR(lat, lon float64, odd, surface bool) (rawLat, rawLon uint32) {
+	span := 360.0
+	if surface {
+		span = 90.0
+	}
+	zones := 60.0
+	if odd {
+		zones = 59.0
+	}
+
+	dlat := span / zones
+	yz := math.Floor(131072*cprModFloat(lat, dlat)/dlat + 0.5)
+	rlat := dlat * (yz/131072 + math.Floor(lat/dlat))
+
+	dlon := cprDlonFunction(rlat, odd, surface)
+	xz := math.Floor(131072*cprModFloat(lon, dlon)/dlon + 0.5)
+
+	return uint32(yz) & 0x1FFFF, uint32(xz) & 0x1FFFF
+}
+
+func TestParseRawLatLon(t *testing.T) {
+	evenLat, evenLon, _ := rawCPR(mustHex("8d40621d58c382d690c8ac2863a7"))
+	oddLat, oddLon, odd := rawCPR(mustHex("8d40621d58c386435cc412692ad6"))
+	if !odd {
+		t.Fatal("odd/even flag not read from bit 54")
+	}
+
+	tests := []struct {
+		name                             string
+		evenLat, evenLon, oddLat, oddLon uint32
+		lastOdd                          bool
+		lat, lon                         float64
+	}{
+		// "The 1090MHz Riddle" and Edward's worked examples
+		{"even last", evenLat, evenLon, oddLat, oddLon, false, 52.25720, 3.91937},
+		{"odd last", evenLat, evenLon, oddLat, oddLon, true, 52.26578, 3.93891},
+		{"edward", 92095, 39846, 88385, 125818, true, 10.21621, 123.88913},
+	}
+	for _, test := range tests {
+		lat, lon := parseRawLatLon(test.evenLat, test.evenLon, test.oddLat, test.oddLon, test.lastOdd)
+		if !closeTo(lat, test.lat) || !closeTo(lon, test.lon) {
+			t.Errorf("%s: got %.5f,%.5f, want %.5f,%.5f", test.name, lat, lon, test.lat, test.lon)
+		}
+	}
+}
+
+// Every hemisphere, both sides of an NL zone boundary, and the polar zones.
+// Southern and western positions need the j and m indices to go negative,
+// which Go's % doesn't wrap; crossing an NL boundary between the frames has
+// to be rejected rather than decoded with the wrong number of zones.
+var cprPositions = []struct{ lat, lon float64 }{
+	{52.2572, 3.9194},
+	{-33.9461, 151.1772},
+	{-34.8222, -58.5358},
+	{40.6398, -73.7789},
+	{0.0001, -0.0001},
+	{-0.0001, 0.0001},
+	{10.4700, 100.0},   // just below the NL 59/58 boundary
+	{-10.4710, -100.0}, // just above it
+	{86.9000, 45.0},    // NL 2
+	{87.5000, -170.0},  // NL 1
+	{-89.9000, 179.9},
+}
+
+func TestParseRawLatLonRoundTrip(t *testing.T) {
+	for _, pos := range cprPositions {
+		evenLat, evenLon := encodeCPR(pos.lat, pos.lon, false, false)
+		oddLat, oddLon := encodeCPR(pos.lat, pos.lon, true, false)
+		for _, lastOdd := range []bool{false, true} {
+			lat, lon := parseRawLatLon(evenLat, evenLon, oddLat, oddLon, lastOdd)
+			if !near(lat, lon, pos.lat, pos.lon) {
+				t.Errorf("%.4f,%.4f (odd last %v): got %.5f,%.5f", pos.lat, pos.lon, lastOdd, lat, lon)
+			}
+		}
+	}
+
+	// the two frames straddle the NL 59/58 boundary
+	evenLat, evenLon := encodeCPR(10.4690, 20.0, false, false)
+	oddLat, oddLon := encodeCPR(10.4720, 20.0, true, false)
+	if lat, _ := parseRawLatLon(evenLat, evenLon, oddLat, oddLon, false); lat != math.MaxFloat64 {
+		t.Errorf("pair across an NL boundary decoded to %.5f", lat)
+	}
+}
+
+func TestParseLocalLatLon(t *testing.T) {
+	rawLat, rawLon, odd := rawCPR(mustHex("8d40621d58c382d690c8ac2863a7"))
+	lat, lon := parseLocalLatLon(rawLat, rawLon, odd, false, 52.258, 3.918)
+	if !closeTo(lat, 52.25720) || !closeTo(lon, 3.91937) {
+		t.Errorf("got %.5f,%.5f, want 52.25720,3.91937", lat, lon)
+	}
+
+	for _, pos := range cprPositions {
+		for _, odd := range []bool{false, true} {
+			for _, surface := range []bool{false, true} {
+				rawLat, rawLon := encodeCPR(pos.lat, pos.lon, odd, surface)
+				// a reference a little way off, as the last position would be
+				refLat := math.Max(-90, math.Min(90, pos.lat+0.2))
+				lat, lon := parseLocalLatLon(rawLat, rawLon, odd, surface, refLat, pos.lon-0.2)
+				if !near(lat, lon, pos.lat, pos.lon) {
+					t.Errorf("%.4f,%.4f (odd %v surface %v): got %.5f,%.5f",
+						pos.lat, pos.lon, odd, surface, lat, lon)
+				}
+			}
+		}
+	}
+}
+
+// The zone nearest the reference can run past ±180; the result has to come
+// back into range.
+func TestParseLocalLatLonAntimeridian(t *testing.T) {
+	tests := []struct{ lat, lon, refLat, refLon float64 }{
+		{-16.9, 179.95, -17.0, -179.95},
+		{-16.9, -179.95, -17.0, 179.95},
+		{52.0, 179.99, 52.1, 179.9},
+		{52.0, -179.99, 52.1, -179.9},
+	}
+	for _, test := range tests {
+		for _, odd := range []bool{false, true} {
+			rawLat, rawLon := encodeCPR(test.lat, test.lon, odd, false)
+			lat, lon := parseLocalLatLon(rawLat, rawLon, odd, false, test.refLat, test.refLon)
+			if lon < -180 || lon > 180 || !near(lat, lon, test.lat, test.lon) {
+				t.Errorf("%.2f,%.2f from %.2f,%.2f (odd %v): got %.5f,%.5f",
+					test.lat, test.lon, test.refLat, test.refLon, odd, lat, lon)
+			}
+		}
+	}
+}
+
+func TestParseRawSurfaceLatLon(t *testing.T) {
+	for _, pos := range cprPositions {
+		evenLat, evenLon := encodeCPR(pos.lat, pos.lon, false, true)
+		oddLat, oddLon := encodeCPR(pos.lat, pos.lon, true, true)
+		lat, lon := parseRawSurfaceLatLon(evenLat, evenLon, oddLat, oddLon, true,
+			pos.lat+1, pos.lon-1)
+		if !near(lat, lon, pos.lat, pos.lon) {
+			t.Errorf("%.4f,%.4f: got %.5f,%.5f", pos.lat, pos.lon, lat, lon)
+		}
+	}
+}
+
+// The surface pair from user-008, decoded all the way through parseModeS
+// against a receiver at Rotterdam.
+func TestSurfacePosition(t *testing.T) {
+	savedLat, savedLon := *baseLat, *baseLon
+	*baseLat, *baseLon = 51.990, 4.375
+	defer func() { *baseLat, *baseLon = savedLat, savedLon }()
+
+	knownAircraft := make(aircraftMap)
+	parseModeS(mustHex("8c4841753aab238733c8cd4020b1"), false, &knownAircraft)
+	parseModeS(mustHex("8c4841753a8a35323faebdac702d"), false, &knownAircraft)
+
+	aircraft, known := knownAircraft[0x484175]
+	if !known {
+		t.Fatal("aircraft not created")
+	}
+	if !aircraft.onGround || !closeTo(aircraft.latitude, 52.32061) || !closeTo(aircraft.longitude, 4.73473) {
+		t.Errorf("got %.5f,%.5f on ground %v, want 52.32061,4.73473 on the ground",
+			aircraft.latitude, aircraft.longitude, aircraft.onGround)
+	}
+}
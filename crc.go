@@ -0,0 +1,165 @@
+// This file is part of Simurgh.
+// Copyright © 2016 Mike Tigas. All rights reserved.
+// This file is licensed under the terms of the GNU Affero General
+// Public License, version 3 or later. See the LICENSE.md file.
+//
+// Some functions in this file are ported from code in mutability/dump1090
+// <https://github.com/mutability/dump1090>, under the GNU Public
+// License v2.
+package main
+
+import (
+	"sync/atomic"
+)
+
+// Mode-S parity is a 24 bit CRC with generator polynomial 0x1FFF409
+// https://github.com/mutability/dump1090/blob/master/crc.c
+const modesGeneratorPoly = uint32(0xFFF409)
+
+var crcTable [256]uint32
+
+// Syndrome -> bit error lookup tables for 56 and 112 bit frames
+var (
+	crcErrors56  map[uint32]crcError
+	crcErrors112 map[uint32]crcError
+)
+
+type crcError struct {
+	bits int
+	pos  [2]int
+}
+
+func init() {
+	for i := 0; i < 256; i++ {
+		c := uint32(i) << 16
+		for j := 0; j < 8; j++ {
+			if c&0x800000 != 0 {
+				c = (c << 1) ^ modesGeneratorPoly
+			} else {
+				c <<= 1
+			}
+		}
+		crcTable[i] = c & 0xFFFFFF
+	}
+
+	crcErrors56 = buildErrorTable(56)
+	crcErrors112 = buildErrorTable(112)
+}
+
+// modesChecksum returns the CRC of everything but the last 24 bits of the
+// message, XORed with those last 24 bits. For DF11/17/18 a clean frame gives
+// 0 (DF11 may have the interrogator ID in the low 7 bits); for the
+// address/parity formats it gives the ICAO address.
+func modesChecksum(message []byte) uint32 {
+	n := len(message) - 3
+
+	rem := uint32(0)
+	for _, b := range message[:n] {
+		rem = ((rem << 8) ^ crcTable[b^byte(rem>>16)]) & 0xFFFFFF
+	}
+
+	return rem ^ (uint32(message[n])<<16 | uint32(message[n+1])<<8 | uint32(message[n+2]))
+}
+
+// buildErrorTable maps the syndrome of every one and two bit error in an
+// nbits long frame back to the bits that caused it. The CRC has no initial
+// value or final XOR, so an error's syndrome doesn't depend on the rest of the
+// frame. Two-bit patterns that share a syndrome with anything else are left
+// out, since we couldn't tell which one to fix.
+func buildErrorTable(nbits int) map[uint32]crcError {
+	table := make(map[uint32]crcError)
+	ambiguous := make(map[uint32]bool)
+	message := make([]byte, nbits/8)
+
+	// Never touch the DF field (the first 5 bits); "fixing" it would just
+	// turn the frame into a different kind of frame.
+	for i := 5; i < nbits; i++ {
+		flipBit(message, i)
+		table[modesChecksum(message)] = crcError{bits: 1, pos: [2]int{i, -1}}
+		flipBit(message, i)
+	}
+
+	for i := 5; i < nbits; i++ {
+		flipBit(message, i)
+		for j := i + 1; j < nbits; j++ {
+			flipBit(message, j)
+			syndrome := modesChecksum(message)
+			if _, exists := table[syndrome]; exists {
+				if table[syndrome].bits == 2 {
+					ambiguous[syndrome] = true
+				}
+			} else {
+				table[syndrome] = crcError{bits: 2, pos: [2]int{i, j}}
+			}
+			flipBit(message, j)
+		}
+		flipBit(message, i)
+	}
+
+	for syndrome := range ambiguous {
+		delete(table, syndrome)
+	}
+	return table
+}
+
+func flipBit(message []byte, bit int) {
+	message[bit/8] ^= 0x80 >> uint(bit%8)
+}
+
+// correctModeSErrors repairs message in place given a non-zero syndrome.
+// It returns the number of bits fixed, or 0 if the error isn't one we can
+// correct. Two-bit fixes are only made with -fixTwoBits.
+func correctModeSErrors(message []byte, syndrome uint32) int {
+	table := crcErrors56
+	if len(message) == 14 {
+		table = crcErrors112
+	}
+
+	e, ok := table[syndrome]
+	if !ok || (e.bits > 1 && !*fixTwoBits) {
+		return 0
+	}
+	for _, bit := range e.pos[:e.bits] {
+		flipBit(message, bit)
+	}
+	return e.bits
+}
+
+// Per-DF frame counters
+type modesDFStats struct {
+	accepted  [32]uint64
+	crcFailed [32]uint64
+	recovered [32]uint64
+	corrected [32]uint64
+
+	positionsRejected uint64
+
+	// Comm-B replies by the register we inferred, and ones we couldn't pin
+	// down to a single register
+	commB          [256]uint64
+	commBAmbiguous uint64
+}
+
+var modesStats modesDFStats
+
+func (s *modesDFStats) countAccepted(linkFmt uint) {
+	atomic.AddUint64(&s.accepted[linkFmt], 1)
+}
+func (s *modesDFStats) countCRCFailed(linkFmt uint) {
+	atomic.AddUint64(&s.crcFailed[linkFmt], 1)
+}
+func (s *modesDFStats) countRecovered(linkFmt uint) {
+	atomic.AddUint64(&s.recovered[linkFmt], 1)
+}
+func (s *modesDFStats) countCorrected(linkFmt uint) {
+	atomic.AddUint64(&s.corrected[linkFmt], 1)
+}
+func (s *modesDFStats) countPositionRejected() {
+	atomic.AddUint64(&s.positionsRejected, 1)
+}
+func (s *modesDFStats) countCommB(bds uint) {
+	atomic.AddUint64(&s.commB[bds], 1)
+}
+func (s *modesDFStats) countCommBAmbiguous() {
+	atomic.AddUint64(&s.commBAmbiguous, 1)
+}
@@ -0,0 +1,136 @@
+// This file is part of Simurgh.
+// Copyright © 2016 Mike Tigas. All rights reserved.
+// This file is licensed under the terms of the GNU Affero General
+// Public License, version 3 or later. See the LICENSE.md file.
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+var crcTestFrames = []struct {
+	name    string
+	message []byte
+}{
+	{"DF17", mustHex("8d4840d6202cc371c32ce0576098")},
+	{"DF17 position", mustHex("8d40621d58c382d690c8ac2863a7")},
+	{"DF11", mustHex("5d4840d6f8740f")},
+}
+
+func setFixTwoBits(t *testing.T, value bool) {
+	saved := *fixTwoBits
+	*fixTwoBits = value
+	t.Cleanup(func() { *fixTwoBits = saved })
+}
+
+// flipRandomBits flips n distinct bits, never in the DF field.
+func flipRandomBits(rng *rand.Rand, message []byte, n int) {
+	nbits := len(message) * 8
+	for _, i := range rng.Perm(nbits - 5)[:n] {
+		flipBit(message, i+5)
+	}
+}
+
+func TestCRCCleanFrames(t *testing.T) {
+	for _, frame := range crcTestFrames {
+		if syndrome := modesChecksum(frame.message); syndrome != 0 {
+			t.Errorf("%s: syndrome %06x", frame.name, syndrome)
+		}
+	}
+}
+
+func TestCorrectModeSErrors(t *testing.T) {
+	const trials = 2000
+	rng := rand.New(rand.NewSource(1))
+
+	tests := []struct {
+		flips      int
+		fixTwoBits bool
+		minRate    float64 // fraction of frames that must come back intact
+		maxRate    float64
+	}{
+		{1, false, 1, 1},
+		{1, true, 1, 1},
+		{2, false, 0, 0},
+		{2, true, 0.95, 1},
+	}
+
+	for _, test := range tests {
+		setFixTwoBits(t, test.fixTwoBits)
+		for _, frame := range crcTestFrames {
+			repaired := 0
+			for trial := 0; trial < trials; trial++ {
+				message := append([]byte{}, frame.message...)
+				flipRandomBits(rng, message, test.flips)
+
+				n := correctModeSErrors(message, modesChecksum(message))
+				switch {
+				case n == 0:
+					continue
+				case n != test.flips || !bytes.Equal(message, frame.message):
+					t.Fatalf("%s, %d bit(s): wrong repair to %x", frame.name, test.flips, message)
+				}
+				repaired++
+			}
+
+			rate := float64(repaired) / trials
+			if rate < test.minRate || rate > test.maxRate {
+				t.Errorf("%s, %d bit(s), fixTwoBits=%v: repaired %.3f, want %.2f-%.2f",
+					frame.name, test.flips, test.fixTwoBits, rate, test.minRate, test.maxRate)
+			}
+		}
+	}
+}
+
+// No two one- or two-bit errors share a syndrome at either frame length, so
+// every pattern should be in the tables.
+func TestErrorTableSizes(t *testing.T) {
+	for _, test := range []struct {
+		table map[uint32]crcError
+		nbits int
+	}{{crcErrors56, 56}, {crcErrors112, 112}} {
+		n := test.nbits - 5
+		if want := n + n*(n-1)/2; len(test.table) != want {
+			t.Errorf("%d bits: %d syndromes, want %d", test.nbits, len(test.table), want)
+		}
+	}
+}
+
+// A syndrome buildErrorTable dropped as ambiguous, or one from an error too
+// big to fix, must leave the frame alone rather than "fix" it into a third,
+// wrong, frame.
+func TestCorrectModeSErrorsUncorrectable(t *testing.T) {
+	setFixTwoBits(t, true)
+	rng := rand.New(rand.NewSource(1))
+
+	for _, frame := range crcTestFrames {
+		table := crcErrors56
+		if len(frame.message) == 14 {
+			table = crcErrors112
+		}
+
+		message := append([]byte{}, frame.message...)
+		flipBit(message, 20)
+		flipBit(message, 40)
+		syndrome := modesChecksum(message)
+		dropped := table[syndrome]
+		delete(table, syndrome)
+		n := correctModeSErrors(message, syndrome)
+		table[syndrome] = dropped
+		if n != 0 || modesChecksum(message) != syndrome {
+			t.Errorf("%s: dropped syndrome %06x repaired %d bit(s)", frame.name, syndrome, n)
+		}
+
+		for trial := 0; trial < 2000; trial++ {
+			message := append([]byte{}, frame.message...)
+			flipRandomBits(rng, message, 3)
+			syndrome := modesChecksum(message)
+			damaged := append([]byte{}, message...)
+			if correctModeSErrors(message, syndrome) == 0 && !bytes.Equal(message, damaged) {
+				t.Fatalf("%s: uncorrectable syndrome %06x changed the frame", frame.name, syndrome)
+			}
+		}
+	}
+}
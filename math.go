@@ -163,25 +163,200 @@ func cprDlonFunction(lat float64, fflag bool, surface bool) float64 {
 
 }
 
+// cprModFunction is a modulo that's always positive, which Go's % isn't
+func cprModFunction(a, b int) int {
+	res := a % b
+	if res < 0 {
+		res += b
+	}
+	return res
+}
+
+func cprModFloat(a, b float64) float64 {
+	res := math.Mod(a, b)
+	if res < 0 {
+		res += b
+	}
+	return res
+}
+
+// decodeMovementField converts the 7 bit surface movement field into a
+// ground speed in knots, or -1 if there's no speed information. The scale is
+// non-linear, with finer steps at taxi speeds.
+func decodeMovementField(movement uint) float64 {
+	switch {
+	case movement == 0 || movement > 124:
+		return -1 // no information, or reserved
+	case movement == 1:
+		return 0 // stopped
+	case movement <= 8:
+		return 0.125 + float64(movement-2)*0.125
+	case movement <= 12:
+		return 1 + float64(movement-9)*0.25
+	case movement <= 38:
+		return 2 + float64(movement-13)*0.5
+	case movement <= 93:
+		return 15 + float64(movement-39)
+	case movement <= 108:
+		return 70 + float64(movement-94)*2
+	case movement <= 123:
+		return 100 + float64(movement-109)*5
+	default:
+		return 175 // 175kt or more
+	}
+}
+
 func decodeAC12Field(ac12Data uint) int32 {
 	q := (ac12Data & 0x10) == 0x10
 	if q {
 		n := int32((ac12Data&0x0FE0)>>1) + int32(ac12Data&0x000F)
 		return (n * 25) - 1000
-	} else {
-		/* TODO
-		// Make N a 13 bit Gillham coded altitude by inserting M=0 at bit 6
-		int n = ((AC12Field & 0x0FC0) << 1) |
-						 (AC12Field & 0x003F);
-		n = ModeAToModeC(decodeID13Field(n));
-		if (n < -12) {
-				return INVALID_ALTITUDE;
-		}
-
-		return (100 * n);
-		*/
+	}
+
+	// Make N a 13 bit Gillham coded altitude by inserting M=0 at bit 6
+	n := ((ac12Data & 0x0FC0) << 1) | (ac12Data & 0x003F)
+	return gillhamAltitude(decodeID13Field(n))
+}
+
+// decodeAC13Field decodes the 13 bit altitude in DF0/4/16/20 replies (and
+// ACAS threat data) to feet, along with the unit it was sent in. It returns
+// math.MaxInt32 if there's no valid altitude.
+func decodeAC13Field(altCode uint) (int32, altitudeUnit) {
+	if (altCode & 0x0040) > 0 {
+		// meters, raw integer with the M bit removed
+		n := ((altCode & 0x1F80) >> 1) | (altCode & 0x003F)
+		return metersToFeet(int32(n)), altitudeUnitMeters
+
+	} else if (altCode & 0x0010) > 0 {
+		// feet, raw integer
+		ac := (altCode&0x1F80)>>2 + (altCode&0x0020)>>1 + (altCode & 0x000F)
+		return int32(ac)*25 - 1000, altitudeUnitFeet
+	}
+
+	// feet, Gillham coded
+	return gillhamAltitude(decodeID13Field(altCode)), altitudeUnitFeet
+}
+
+// decodeID13Field reorders the bits of a 13 bit identity/altitude field
+// (C1 A1 C2 A2 C4 A4 X B1 D1 B2 D2 B4 D4) into "hex Gillham" form, where
+// each nibble holds one octal digit: 0xABCD.
+func decodeID13Field(id13Field uint) uint {
+	hexGillham := uint(0)
+
+	if id13Field&0x1000 != 0 {
+		hexGillham |= 0x0010 // C1
+	}
+	if id13Field&0x0800 != 0 {
+		hexGillham |= 0x1000 // A1
+	}
+	if id13Field&0x0400 != 0 {
+		hexGillham |= 0x0020 // C2
+	}
+	if id13Field&0x0200 != 0 {
+		hexGillham |= 0x2000 // A2
+	}
+	if id13Field&0x0100 != 0 {
+		hexGillham |= 0x0040 // C4
+	}
+	if id13Field&0x0080 != 0 {
+		hexGillham |= 0x4000 // A4
+	}
+	// 0x0040 is X, or M in an altitude field
+	if id13Field&0x0020 != 0 {
+		hexGillham |= 0x0100 // B1
+	}
+	if id13Field&0x0010 != 0 {
+		hexGillham |= 0x0001 // D1, or Q in an altitude field
+	}
+	if id13Field&0x0008 != 0 {
+		hexGillham |= 0x0200 // B2
+	}
+	if id13Field&0x0004 != 0 {
+		hexGillham |= 0x0002 // D2
+	}
+	if id13Field&0x0002 != 0 {
+		hexGillham |= 0x0400 // B4
+	}
+	if id13Field&0x0001 != 0 {
+		hexGillham |= 0x0004 // D4
+	}
+
+	return hexGillham
+}
+
+// modeAToModeC converts a hex Gillham Mode A code into a Mode C altitude in
+// hundreds of feet (-12 to 1267), or false if it isn't a valid altitude.
+func modeAToModeC(modeA uint) (int32, bool) {
+	// unused bits and D1 must be zero; C1-C4 can't all be zero
+	if modeA&0xFFFF8889 != 0 || modeA&0x00F0 == 0 {
+		return 0, false
+	}
+
+	// The 100ft increments are a 3 bit Gray code (C1, C2, C4)...
+	oneHundreds := uint(0)
+	if modeA&0x0010 != 0 {
+		oneHundreds ^= 0x007 // C1
+	}
+	if modeA&0x0020 != 0 {
+		oneHundreds ^= 0x003 // C2
+	}
+	if modeA&0x0040 != 0 {
+		oneHundreds ^= 0x001 // C4
+	}
+
+	// Remove 7s from oneHundreds (make 7->5, and 5->7)
+	if oneHundreds&5 == 5 {
+		oneHundreds ^= 2
+	}
+
+	// only 1 to 5 are valid
+	if oneHundreds > 5 {
+		return 0, false
+	}
+
+	// ...and the 500ft increments are a Gray code over D2 D4 A1 A2 A4 B1 B2 B4
+	fiveHundreds := uint(0)
+	if modeA&0x0002 != 0 {
+		fiveHundreds ^= 0x0FF // D2
+	}
+	if modeA&0x0004 != 0 {
+		fiveHundreds ^= 0x07F // D4
+	}
+	if modeA&0x1000 != 0 {
+		fiveHundreds ^= 0x03F // A1
+	}
+	if modeA&0x2000 != 0 {
+		fiveHundreds ^= 0x01F // A2
+	}
+	if modeA&0x4000 != 0 {
+		fiveHundreds ^= 0x00F // A4
+	}
+	if modeA&0x0100 != 0 {
+		fiveHundreds ^= 0x007 // B1
+	}
+	if modeA&0x0200 != 0 {
+		fiveHundreds ^= 0x003 // B2
+	}
+	if modeA&0x0400 != 0 {
+		fiveHundreds ^= 0x001 // B4
+	}
+
+	// the 100ft count runs backwards in odd 500ft bands
+	if fiveHundreds&1 != 0 {
+		oneHundreds = 6 - oneHundreds
+	}
+
+	return int32(fiveHundreds*5+oneHundreds) - 13, true
+}
+
+// gillhamAltitude returns the altitude in feet for a hex Gillham code, or
+// math.MaxInt32 if the code isn't a valid altitude.
+func gillhamAltitude(hexGillham uint) int32 {
+	n, ok := modeAToModeC(hexGillham)
+	if !ok || n < -12 {
 		return int32(math.MaxInt32)
 	}
+	return 100 * n
 }
 
 func greatcircle(lat0, lon0, lat1, lon1 float64) float64 {
@@ -201,3 +376,24 @@ func greatcircle(lat0, lon0, lat1, lon1 float64) float64 {
 func metersInMiles(dist float64) float64 {
 	return dist / float64(1609.34721869)
 }
+
+func knotsToMetersPerSecond(knots float64) float64 {
+	return knots * 1852.0 / 3600.0
+}
+
+func metersToFeet(meters int32) int32 {
+	return int32(math.Floor(float64(meters)*3.28084 + 0.5))
+}
+
+func feetToMeters(feet int32) int32 {
+	return int32(math.Floor(float64(feet)/3.28084 + 0.5))
+}
+
+// angleDifference returns how far apart two bearings are, 0-180 degrees
+func angleDifference(a, b float64) float64 {
+	diff := cprModFloat(a-b, 360)
+	if diff > 180 {
+		diff = 360 - diff
+	}
+	return diff
+}
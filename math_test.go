@@ -0,0 +1,139 @@
+// This file is part of Simurgh.
+// Copyright © 2016 Mike Tigas. All rights reserved.
+// This file is licensed under the terms of the GNU Affero General
+// Public License, version 3 or later. See the LICENSE.md file.
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// Gillham codes at the ends of the range and on either side of 500ft band
+// changes, in hex Gillham form and as they appear in a 13 bit AC field (M=0,
+// Q=0) and a 12 bit ES altitude (Q=0).
+var gillhamTests = []struct {
+	altitude int32
+	hex      uint
+	ac13     uint
+	ac12     uint
+}{
+	{-1200, 0x0040, 0x0100, 0x080},
+	{-1100, 0x0060, 0x0500, 0x280},
+	{-800, 0x0010, 0x1000, 0x800},
+	{-700, 0x0410, 0x1002, 0x802},
+	{-300, 0x0440, 0x0102, 0x082},
+	{-200, 0x0640, 0x010a, 0x08a},
+	{0, 0x0620, 0x040a, 0x20a},
+	{200, 0x0610, 0x100a, 0x80a},
+	{300, 0x0210, 0x1008, 0x808},
+	{9800, 0x6540, 0x03a2, 0x1e2},
+	{9900, 0x6560, 0x07a2, 0x3e2},
+	{10000, 0x6520, 0x06a2, 0x362},
+	{35000, 0x5124, 0x0ca1, 0x661},
+	{126200, 0x0412, 0x1006, 0x806},
+	{126300, 0x0012, 0x1004, 0x804},
+	{126700, 0x0042, 0x0104, 0x084},
+}
+
+func TestGillhamAltitude(t *testing.T) {
+	for _, test := range gillhamTests {
+		if got := gillhamAltitude(test.hex); got != test.altitude {
+			t.Errorf("gillhamAltitude(%04x) = %d, want %d", test.hex, got, test.altitude)
+		}
+		if got := decodeID13Field(test.ac13); got != test.hex {
+			t.Errorf("decodeID13Field(%04x) = %04x, want %04x", test.ac13, got, test.hex)
+		}
+		if got, unit := decodeAC13Field(test.ac13); got != test.altitude || unit != altitudeUnitFeet {
+			t.Errorf("decodeAC13Field(%04x) = %d %v, want %d feet", test.ac13, got, unit, test.altitude)
+		}
+		if got := decodeAC12Field(test.ac12); got != test.altitude {
+			t.Errorf("decodeAC12Field(%03x) = %d, want %d", test.ac12, got, test.altitude)
+		}
+	}
+}
+
+// encodeGillham is the Mode C Gray code from ICAO Annex 10 Vol IV,
+// built up from the altitude rather than decoded.
+func encodeGillham(altitude int32) uint {
+	n := altitude/100 + 12
+	fiveHundreds, oneHundreds := uint(n/5), uint(n%5+1)
+	if fiveHundreds%2 == 1 {
+		oneHundreds = 6 - oneHundreds
+	}
+
+	hex := uint(0)
+	gray := fiveHundreds ^ fiveHundreds>>1
+	for i, bit := range []uint{0x0002, 0x0004, 0x1000, 0x2000, 0x4000, 0x0100, 0x0200, 0x0400} {
+		if gray&(0x80>>uint(i)) != 0 {
+			hex |= bit // D2 D4 A1 A2 A4 B1 B2 B4
+		}
+	}
+	hex |= []uint{0, 0x0040, 0x0060, 0x0020, 0x0030, 0x0010}[oneHundreds] // C1 C2 C4
+	return hex
+}
+
+func TestGillhamBandChanges(t *testing.T) {
+	for altitude := int32(-800); altitude < 126700; altitude += 500 {
+		for _, alt := range []int32{altitude, altitude + 100} {
+			hex := encodeGillham(alt)
+			if got := gillhamAltitude(hex); got != alt {
+				t.Errorf("gillhamAltitude(%04x) = %d, want %d", hex, got, alt)
+			}
+		}
+	}
+}
+
+func TestGillhamAltitudeInvalid(t *testing.T) {
+	for _, hex := range []uint{
+		0x0000, // no C bits
+		0x0602, // no C bits
+		0x0041, // D1
+		0x0621, // D1
+		0x0050, // C1 and C4, a 100ft "7"
+		0x0070, // C1, C2 and C4, a 100ft "6"
+	} {
+		if got := gillhamAltitude(hex); got != math.MaxInt32 {
+			t.Errorf("gillhamAltitude(%04x) = %d, want invalid", hex, got)
+		}
+	}
+}
+
+func TestDecodeAC13Field(t *testing.T) {
+	tests := []struct {
+		ac13     uint
+		altitude int32
+		unit     altitudeUnit
+	}{
+		{0x1690, 35000, altitudeUnitFeet},                // Q=1, 25ft steps
+		{0x0010, -1000, altitudeUnitFeet},                // Q=1, bottom of the range
+		{0x0ab5, 16325, altitudeUnitFeet},                // Q=1, bits either side of M
+		{0x07e8, metersToFeet(1000), altitudeUnitMeters}, // M=1
+		{0x0000, math.MaxInt32, altitudeUnitFeet},        // no altitude
+		{0x0002, math.MaxInt32, altitudeUnitFeet},        // Gillham with no C bits
+	}
+	for _, test := range tests {
+		if got, unit := decodeAC13Field(test.ac13); got != test.altitude || unit != test.unit {
+			t.Errorf("decodeAC13Field(%04x) = %d %v, want %d %v", test.ac13, got, unit,
+				test.altitude, test.unit)
+		}
+	}
+}
+
+func TestDecodeAC12Field(t *testing.T) {
+	tests := []struct {
+		ac12     uint
+		altitude int32
+	}{
+		{0xb50, 35000},         // Q=1
+		{0x010, -1000},         // Q=1, bottom of the range
+		{0xfff, 50175},         // Q=1, top of the range
+		{0x000, math.MaxInt32}, // Q=0 with no C bits
+		{0x001, math.MaxInt32}, // Q=0 with no C bits
+	}
+	for _, test := range tests {
+		if got := decodeAC12Field(test.ac12); got != test.altitude {
+			t.Errorf("decodeAC12Field(%03x) = %d, want %d", test.ac12, got, test.altitude)
+		}
+	}
+}
@@ -20,6 +20,12 @@ func parseModeS(message []byte, isMlat bool, knownAircraft *aircraftMap) {
 	// https://github.com/mutability/dump1090/blob/master/mode_s.c
 	linkFmt := uint((message[0] & 0xF8) >> 3)
 
+	// DF0-15 are 56 bit replies, DF16 and up are 112 bit. Drop anything that
+	// doesn't match, rather than reading past the end of a short frame.
+	if len(message) != modesMessageLen(linkFmt) {
+		return
+	}
+
 	var aircraft aircraftData
 	var aircraftExists bool
 	icaoAddr := uint32(math.MaxUint32)
@@ -59,32 +65,88 @@ func parseModeS(message []byte, isMlat bool, knownAircraft *aircraftMap) {
 	//fmt.Printf("UF: %08s\n", strconv.FormatInt(linkFmt, 2))
 	//fmt.Println(msgType)
 
-	if linkFmt == 11 || linkFmt == 17 || linkFmt == 18 {
+	// DF19 is military; only application field 0 is a format we know,
+	// which is laid out like DF17
+	if linkFmt == 19 && message[0]&7 != 0 {
+		return
+	}
+
+	syndrome := modesChecksum(message)
+	correctedBits := 0
+
+	switch linkFmt {
+	case 11:
+		// All-call reply: the parity may be overlaid with the interrogator
+		// ID, which only touches the low 7 bits
+		if syndrome&0xFFFF80 != 0 {
+			modesStats.countCRCFailed(linkFmt)
+			return
+		}
 		icaoAddr = uint32(message[1])*65536 + uint32(message[2])*256 + uint32(message[3])
+		modesStats.countAccepted(linkFmt)
 		//fmt.Printf("ICAO: %06x\n", icaoAddr)
+
+	case 17, 18, 19:
+		if syndrome != 0 {
+			correctedBits = correctModeSErrors(message, syndrome)
+			if correctedBits == 0 {
+				modesStats.countCRCFailed(linkFmt)
+				return
+			}
+		}
+		icaoAddr = uint32(message[1])*65536 + uint32(message[2])*256 + uint32(message[3])
+		if linkFmt == 18 {
+			var isAircraft bool
+			if icaoAddr, isAircraft = df18Address(message, icaoAddr, knownAircraft); !isAircraft {
+				if correctedBits > 0 {
+					modesStats.countCorrected(linkFmt)
+				}
+				modesStats.countAccepted(linkFmt)
+				return
+			}
+		}
+		if !acceptCorrected(knownAircraft, icaoAddr, correctedBits) {
+			modesStats.countCRCFailed(linkFmt)
+			return
+		}
+		if correctedBits > 0 {
+			modesStats.countCorrected(linkFmt)
+		}
+		modesStats.countAccepted(linkFmt)
+
+	case 0, 4, 5, 16, 20, 21:
+		// Address/parity: the AP field is the parity XORed with the address,
+		// so what's left over is the address. Any bit error just gives us a
+		// different address, so only trust addresses we've already seen in a
+		// CRC-clean squitter.
+		if !heardFrom(knownAircraft, syndrome) {
+			modesStats.countCRCFailed(linkFmt)
+			return
+		}
+		icaoAddr = syndrome
+		modesStats.countAccepted(linkFmt)
+		modesStats.countRecovered(linkFmt)
 	}
 
 	if icaoAddr != math.MaxUint32 {
 		var ptrAircraft *aircraftData
 		ptrAircraft, aircraftExists = (*knownAircraft)[icaoAddr]
 		if !aircraftExists {
-			// initialize some values
-			aircraft = aircraftData{
-				icaoAddr:  icaoAddr,
-				oRawLat:   math.MaxUint32,
-				oRawLon:   math.MaxUint32,
-				eRawLat:   math.MaxUint32,
-				eRawLon:   math.MaxUint32,
-				latitude:  math.MaxFloat64,
-				longitude: math.MaxFloat64,
-				altitude:  math.MaxInt32,
-				callsign:  "",
-				mlat:      isMlat}
+			aircraft = newAircraftData(icaoAddr)
+			aircraft.mlat = isMlat
 		} else {
 			aircraft = (*ptrAircraft)
 			aircraft.mlat = isMlat
 		}
 		aircraft.lastPing = time.Now()
+		if correctedBits > 0 {
+			aircraft.correctedFrames++
+			aircraft.lastCorrected = aircraft.lastPing
+		}
+		// extended squitters say where they came from themselves
+		if linkFmt != 17 && linkFmt != 18 && linkFmt != 19 {
+			aircraft.setSource(sourceModeS)
+		}
 	}
 	//fmt.Println(aircraft)
 	//fmt.Println(aircraftExists)
@@ -92,40 +154,159 @@ func parseModeS(message []byte, isMlat bool, knownAircraft *aircraftMap) {
 	if linkFmt == 0 || linkFmt == 4 || linkFmt == 16 || linkFmt == 20 {
 		// Altitude: 13 bit signal
 		altCode = (uint16(message[2])*256 + uint16(message[3])) & 0x1FFF
+		var unit altitudeUnit
+		altitude, unit = decodeAC13Field(uint(altCode))
 
-		if (altCode & 0x0040) > 0 {
-			// meters
-			// TODO
-			//fmt.Println("meters")
+		if altitude != math.MaxInt32 {
+			aircraft.altitude = altitude
+			aircraft.altitudeUnit = unit
+		}
+	}
 
-		} else if (altCode & 0x0010) > 0 {
-			// feet, raw integer
-			ac := (altCode&0x1F80)>>2 + (altCode&0x0020)>>1 + (altCode & 0x000F)
-			altitude = int32((ac * 25) - 1000)
-			// TODO
-			//fmt.Println("int altitude: ", altitude)
+	if linkFmt == 0 || linkFmt == 16 {
+		decodeAirAirSurveillance(message, &aircraft)
+	}
 
-		} else if (altCode & 0x0010) == 0 {
-			// feet, Gillham coded
-			// TODO
-			//fmt.Println("gillham")
-		}
+	if linkFmt == 4 || linkFmt == 5 || linkFmt == 20 || linkFmt == 21 {
+		// Flight status: 2-4 carry the alert bit, 4-5 the SPI (ident) bit
+		fs := message[0] & 7
+		aircraft.fsAlert = fs == 2 || fs == 3 || fs == 4
+		aircraft.fsSPI = fs == 4 || fs == 5
+	}
 
-		if altitude != math.MaxInt32 {
-			aircraft.altitude = altitude
+	if linkFmt == 5 || linkFmt == 21 {
+		// Identity: 13 bit Mode A code
+		id13 := (uint(message[2])*256 + uint(message[3])) & 0x1FFF
+		aircraft.setSquawk(decodeID13Field(id13))
+	}
+
+	if linkFmt == 16 && getBits(message, 33, 40) == 0x30 {
+		// The MV field of a long air-air reply is a coordination message,
+		// with the same layout as BDS 3,0
+		if ra, ok := decodeResolutionAdvisory(message); ok {
+			aircraft.setRA(ra, "DF16 MV")
 		}
 	}
 
-	if linkFmt == 17 || linkFmt == 18 {
-		decodeExtendedSquitter(message, linkFmt, &aircraft)
+	if linkFmt == 20 || linkFmt == 21 {
+		decodeCommB(message, &aircraft)
+	}
+
+	if linkFmt == 17 || linkFmt == 18 || linkFmt == 19 {
+		decodeExtendedSquitter(message, linkFmt, correctedBits > 0, &aircraft)
 	}
 
 	if icaoAddr != math.MaxUint32 {
+		if aircraft.raPending {
+			recordRA(&aircraft, knownAircraft)
+		}
+		checkAlerts(&aircraft)
 		(*knownAircraft)[icaoAddr] = &aircraft
 	}
 	//fmt.Println(aircraft)
 }
 
+// acceptCorrected decides whether to believe a frame that needed correctedBits
+// bits repaired. A wrong repair gives a clean-looking frame from an address
+// nobody is using, which would then also let AP replies "recover" that
+// address, so repaired frames only count for aircraft we already know.
+func acceptCorrected(knownAircraft *aircraftMap, icaoAddr uint32, correctedBits int) bool {
+	return correctedBits == 0 || heardFrom(knownAircraft, icaoAddr)
+}
+
+// heardFrom reports whether we've decoded a frame from the address ourselves.
+// Aircraft we only know of through SBS don't count: that's someone else's
+// decoding, with its own error handling we can't see.
+func heardFrom(knownAircraft *aircraftMap, icaoAddr uint32) bool {
+	aircraft, known := (*knownAircraft)[icaoAddr]
+	return known && aircraft.source != sourceSBS
+}
+
+// decodeAirAirSurveillance handles the VS and RI fields of DF0/16 replies
+// to ACAS interrogations. What RI holds depends on what the interrogator
+// asked for: codes 0-7 describe the aircraft's ACAS, 8-15 its maximum
+// cruising airspeed.
+func decodeAirAirSurveillance(message []byte, aircraft *aircraftData) {
+	now := time.Now()
+
+	aircraft.vsOnGround = message[0]&4 != 0
+	aircraft.lastVerticalStatus = now
+
+	if ri := getBits(message, 14, 17); ri < 8 {
+		aircraft.acasCapability = ri
+		aircraft.lastACASCapability = now
+	} else if ri < 15 {
+		aircraft.maxAirspeed = ri
+		aircraft.lastMaxAirspeed = now
+	}
+}
+
+// df18Address works out where a DF18 frame's address belongs: addresses
+// that aren't ICAO addresses are moved out of the way with nonICAOAddress.
+// It returns false for frames that aren't about a single aircraft.
+//
+// For fine TIS-B and ADS-R only positions and velocities carry the IMF bit
+// that tells us the address type. Other messages go to the non-ICAO entry if
+// that's the only one we have for the address.
+func df18Address(message []byte, addr uint32, knownAircraft *aircraftMap) (uint32, bool) {
+	msgType := uint(message[4]) >> 3
+
+	switch message[0] & 7 {
+	case cfADSB:
+		return addr, true
+	case cfADSBOther, cfTISBOther:
+		return addr | nonICAOAddress, true
+	case cfTISBFine, cfADSR:
+		switch {
+		case (msgType >= 9 && msgType <= 18) || (msgType >= 20 && msgType <= 22):
+			// ME bit 8
+			if getBits(message, 40, 40) == 1 {
+				return addr | nonICAOAddress, true
+			}
+			return addr, true
+		case msgType == 19:
+			// ME bit 9
+			if getBits(message, 41, 41) == 1 {
+				return addr | nonICAOAddress, true
+			}
+			return addr, true
+		}
+		_, icaoKnown := (*knownAircraft)[addr]
+		if _, otherKnown := (*knownAircraft)[addr|nonICAOAddress]; otherKnown && !icaoKnown {
+			return addr | nonICAOAddress, true
+		}
+		return addr, true
+	case cfTISBCoarse:
+		// the IMF is the first ME bit
+		if getBits(message, 33, 33) == 1 {
+			return addr | nonICAOAddress, true
+		}
+		return addr, true
+	}
+	// TIS-B/ADS-R management messages, and reserved
+	return addr, false
+}
+
+func modesMessageLen(linkFmt uint) int {
+	if linkFmt&0x10 != 0 {
+		return 14
+	}
+	return 7
+}
+
+// getBits returns bits first through last (inclusive, numbered from 1 like
+// the Mode-S specs do) of message as an integer.
+func getBits(message []byte, first, last int) uint {
+	value := uint(0)
+	for bit := first - 1; bit < last; bit++ {
+		value <<= 1
+		if message[bit/8]&(0x80>>uint(bit%8)) != 0 {
+			value |= 1
+		}
+	}
+	return value
+}
+
 func parseTime(timebytes []byte) time.Time {
 	// Takes a 6 byte array, which represents a 48bit GPS timestamp
 	// http://wiki.modesbeast.com/Radarcape:Firmware_Versions#The_GPS_timestamp
@@ -153,26 +334,24 @@ func parseTime(timebytes []byte) time.Time {
 		hr, min, sec, nanoSeconds, time.UTC)
 }
 
-func decodeExtendedSquitter(message []byte, linkFmt uint, aircraft *aircraftData) {
+func decodeExtendedSquitter(message []byte, linkFmt uint, repaired bool, aircraft *aircraftData) {
 
 	var callsign string
-
-	//if linkFmt == 18 {
-	//  switch (message[0] & 7) {
-	//  case 1:
-	//    fmt.Println("Non-ICAO")
-	//  case 2:
-	//    fmt.Println("TIS-B fine")
-	//  case 3:
-	//    fmt.Println("TIS-B coarse")
-	//  case 5:
-	//    fmt.Println("TIS-B anon ADS-B relay")
-	//  case 6:
-	//    fmt.Println("ADS-B rebroadcast")
-	//  default:
-	//    fmt.Println("Non-ICAO unknown")
-	//  }
-	//}
+	aircraft.lastES = time.Now()
+
+	source := sourceADSB
+	if linkFmt == 18 {
+		switch message[0] & 7 {
+		case cfTISBFine, cfTISBCoarse, cfTISBOther:
+			source = sourceTISB
+		case cfADSR:
+			source = sourceADSR
+		}
+	}
+	aircraft.setSource(source)
+	if linkFmt == 18 && message[0]&7 == cfTISBCoarse {
+		return // has its own layout, which we don't decode
+	}
 
 	msgType := uint(message[4]) >> 3
 	var msgSubType uint
@@ -189,10 +368,16 @@ func decodeExtendedSquitter(message []byte, linkFmt uint, aircraft *aircraftData
 	latitude := float64(math.MaxFloat64)
 	longitude := float64(math.MaxFloat64)
 	altitude := int32(math.MaxInt32)
+	surface := false
 
 	switch msgType {
 	case 1, 2, 3, 4:
-		// Aircraft ID
+		// Aircraft ID, plus the emitter category: the type code picks the
+		// set (4 is A, 3 is B, 2 is C, 1 is D) and the subtype the entry.
+		if msgSubType != 0 {
+			aircraft.category = (0x0E-msgType)<<4 | msgSubType
+		}
+
 		chars1 := uint(message[5])<<16 + uint(message[6])<<8 + uint(message[7])
 		chars2 := uint(message[8])<<16 + uint(message[9])<<8 + uint(message[10])
 
@@ -227,16 +412,47 @@ func decodeExtendedSquitter(message []byte, linkFmt uint, aircraft *aircraftData
 			//fmt.Println("Callsign: ", callsign)
 		}
 
-	//case 19:
-	//  // Airborne Velocity
+	case 19:
+		// Airborne Velocity
+		decodeAirborneVelocity(message, msgSubType, aircraft)
+
+	case 28:
+		// Aircraft status
+		if msgSubType == 1 {
+			// Emergency/priority status, plus the Mode A code
+			aircraft.emergencyState = getBits(message, 41, 43)
+			if id13 := getBits(message, 44, 56); id13 != 0 {
+				aircraft.setSquawk(decodeID13Field(id13))
+			}
+		} else if msgSubType == 2 {
+			// ACAS RA broadcast, laid out like BDS 3,0
+			if ra, ok := decodeResolutionAdvisory(message); ok {
+				aircraft.setRA(ra, "ES 28/2")
+			}
+		}
+
+	case 29:
+		// Target state and status; subtype 1 is the version 2 format
+		if msgSubType == 1 {
+			decodeTargetState(message, aircraft)
+		}
+
+	case 31:
+		// Operational status; subtype 0 is airborne, 1 is surface
+		if msgSubType == 0 || msgSubType == 1 {
+			decodeOperationalStatus(message, msgSubType == 1, aircraft)
+		}
 
 	case 5, 6, 7, 8:
 		// Ground position
+		surface = true
 		rawLatitude = uint32(message[6])&3<<15 + uint32(message[7])<<7 +
 			uint32(message[8])>>1
 		rawLongitude = uint32(message[8])&1<<16 + uint32(message[9])<<8 +
 			uint32(message[10])
 
+		decodeSurfaceMovement(message, aircraft)
+
 	case 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 20, 21, 22:
 		// Airborne position
 
@@ -247,6 +463,12 @@ func decodeExtendedSquitter(message []byte, linkFmt uint, aircraft *aircraftData
 			rawLongitude = uint32(message[8])&1<<16 + uint32(message[9])<<8 +
 				uint32(message[10])
 		}
+		// ME bit 8 is the NIC supplement-B from version 2 on; before that
+		// it was the single antenna flag, and in TIS-B and ADS-R it's the IMF
+		if aircraft.adsbVersion >= 2 && source == sourceADSB {
+			aircraft.nicSupplementB = getBits(message, 40, 40) == 1
+		}
+
 		if msgType != 20 && msgType != 21 && msgType != 22 {
 			//altitude :=
 			//fmt.Printf("ac12: %#04x\n", ac12Data)
@@ -254,34 +476,19 @@ func decodeExtendedSquitter(message []byte, linkFmt uint, aircraft *aircraftData
 
 			altitude = decodeAC12Field(ac12Data)
 
-		} else {
-			// "HAE" ac2-encoded altitude
-			// TODO
+		} else if geomAltitude := decodeAC12Field(ac12Data); geomAltitude != math.MaxInt32 {
+			// GNSS height above the ellipsoid, encoded like the baro altitude
+			aircraft.geomAltitude = geomAltitude
+			aircraft.geomAltitudeDerived = false
+			aircraft.lastGeomAltitude = time.Now()
 		}
 	}
 
 	if (rawLatitude != math.MaxUint32) && (rawLongitude != math.MaxUint32) {
-		tFlag := (byte(message[6]) & 8) == 8
 		isOddFrame := (byte(message[6]) & 4) == 4
-
-		if isOddFrame && aircraft.eRawLat != math.MaxUint32 && aircraft.eRawLon != math.MaxUint32 {
-			// Odd frame and we have previous even frame data
-			latitude, longitude = parseRawLatLon(aircraft.eRawLat, aircraft.eRawLon, rawLatitude, rawLongitude, isOddFrame, tFlag)
-			// Reset our buffer
-			aircraft.eRawLat = math.MaxUint32
-			aircraft.eRawLon = math.MaxUint32
-		} else if !isOddFrame && aircraft.oRawLat != math.MaxUint32 && aircraft.oRawLon != math.MaxUint32 {
-			// Even frame and we have previous odd frame data
-			latitude, longitude = parseRawLatLon(rawLatitude, rawLongitude, aircraft.oRawLat, aircraft.oRawLon, isOddFrame, tFlag)
-			// Reset buffer
-			aircraft.oRawLat = math.MaxUint32
-			aircraft.oRawLon = math.MaxUint32
-		} else if isOddFrame {
-			aircraft.oRawLat = rawLatitude
-			aircraft.oRawLon = rawLongitude
-		} else if !isOddFrame {
-			aircraft.eRawLat = rawLatitude
-			aircraft.eRawLon = rawLongitude
+		latitude, longitude = decodeCPR(aircraft, rawLatitude, rawLongitude, isOddFrame, surface)
+		if latitude != math.MaxFloat64 && !positionPlausible(aircraft, latitude, longitude) {
+			latitude, longitude = math.MaxFloat64, math.MaxFloat64
 		}
 	}
 
@@ -295,17 +502,510 @@ func decodeExtendedSquitter(message []byte, linkFmt uint, aircraft *aircraftData
 	}
 	if altitude != math.MaxInt32 {
 		aircraft.altitude = altitude
+		aircraft.altitudeUnit = altitudeUnitFeet
 	}
 	if latitude != math.MaxFloat64 && longitude != math.MaxFloat64 {
 		aircraft.latitude = latitude
 		aircraft.longitude = longitude
 		aircraft.lastPos = time.Now()
+
+		nic, rc := containmentRadius(msgType, aircraft)
+		aircraft.posQuality = positionQuality{reported: true, nic: nic, rc: rc,
+			nacp: aircraft.nacp, sil: aircraft.sil, repaired: repaired}
+	}
+}
+
+// containmentRadius returns the NIC and the horizontal containment radius in
+// meters (0 if unknown) for a position of the given type code. Several type
+// codes cover more than one NIC, told apart by the NIC supplements; version 0
+// aircraft don't send those, so they get the default (supplements clear).
+// https://mode-s.org/decode/content/ads-b/7-uncertainty.html
+func containmentRadius(msgType uint, aircraft *aircraftData) (uint, float64) {
+	if aircraft.adsbVersion == 1 {
+		return containmentRadiusV1(msgType, aircraft.nicSupplementA)
+	}
+
+	nicA := aircraft.nicSupplementA
+	nicB := aircraft.nicSupplementB
+	nicC := aircraft.nicSupplementC
+
+	switch msgType {
+	case 9, 20:
+		return 11, 7.5
+	case 10, 21:
+		return 10, 25
+	case 11:
+		if nicA && nicB {
+			return 9, 75
+		}
+		return 8, 185.2
+	case 12:
+		return 7, 370.4
+	case 13:
+		if nicA && nicB {
+			return 6, 1111.2
+		} else if nicB {
+			return 6, 555.6
+		}
+		return 6, 926
+	case 14:
+		return 5, 1852
+	case 15:
+		return 4, 3704
+	case 16:
+		if nicA && nicB {
+			return 3, 7408
+		}
+		return 2, 14816
+	case 17:
+		return 1, 37040
+
+	// surface positions use NIC-A and NIC-C
+	case 5:
+		return 11, 7.5
+	case 6:
+		return 10, 25
+	case 7:
+		if nicA {
+			return 9, 75
+		}
+		return 8, 185.2
+	case 8:
+		if nicA && nicC {
+			return 7, 370.4
+		} else if nicA {
+			return 6, 555.6
+		} else if nicC {
+			return 6, 1111.2
+		}
+	}
+	return 0, 0
+}
+
+// containmentRadiusV1 is containmentRadius for version 1, where there's a
+// single NIC supplement, sent in the operational status message.
+func containmentRadiusV1(msgType uint, nicS bool) (uint, float64) {
+	switch msgType {
+	case 9, 20, 5:
+		return 11, 7.5
+	case 10, 21, 6:
+		return 10, 25
+	case 11, 7:
+		if nicS {
+			return 9, 75
+		}
+		return 8, 185.2
+	case 12:
+		return 7, 370.4
+	case 13:
+		if nicS {
+			return 6, 555.6
+		}
+		return 6, 926
+	case 14:
+		return 5, 1852
+	case 15:
+		return 4, 3704
+	case 16:
+		if nicS {
+			return 3, 7408
+		}
+		return 2, 14816
+	case 17:
+		return 1, 37040
 	}
+	return 0, 0
+}
+
+// decodeOperationalStatus handles ES type 31. Most importantly it carries
+// the ADS-B version, which changes how other fields (NIC supplements, NACp,
+// SIL...) have to be read. Until we've seen one, an aircraft is assumed to
+// be version 0, as the standard says.
+func decodeOperationalStatus(message []byte, surface bool, aircraft *aircraftData) {
+	version := getBits(message, 73, 75)
+	aircraft.adsbVersion = version
+	aircraft.lastOpStatus = time.Now()
+
+	if surface {
+		aircraft.capabilityClass = getBits(message, 41, 52)
+	} else {
+		aircraft.capabilityClass = getBits(message, 41, 56)
+	}
+
+	// Version 0 only has the capability class, and the rest of the frame
+	// means something else (or nothing)
+	if version == 0 {
+		return
+	}
+
+	aircraft.operationalMode = getBits(message, 57, 72)
+	aircraft.nicSupplementA = getBits(message, 76, 76) == 1
+	aircraft.nacp = getBits(message, 77, 80)
+	aircraft.sil = getBits(message, 83, 84)
+
+	if surface {
+		aircraft.lengthWidth = getBits(message, 53, 56)
+	}
+
+	if version >= 2 {
+		// System design assurance, in the operational mode field
+		aircraft.sda = getBits(message, 63, 64)
+		aircraft.silSupplement = getBits(message, 87, 87) == 1
+		if surface {
+			aircraft.nicSupplementC = getBits(message, 52, 52) == 1
+		} else {
+			aircraft.gva = getBits(message, 81, 82)
+		}
+	}
+}
+
+// decodeTargetState handles the version 2 target state and status message
+// (ES type 29 subtype 1): what the crew has set on the MCP/FCU or FMS, and
+// which autopilot modes are engaged.
+func decodeTargetState(message []byte, aircraft *aircraftData) {
+	now := time.Now()
+
+	if altRaw := getBits(message, 42, 52); altRaw != 0 {
+		aircraft.selectedAltitude = int32(altRaw-1) * 32
+		aircraft.selectedAltitudeFMS = getBits(message, 41, 41) == 1
+		aircraft.lastSelectedAltitude = now
+	}
+
+	if baroRaw := getBits(message, 53, 61); baroRaw != 0 {
+		aircraft.baroSetting = 800.0 + float64(baroRaw-1)*0.8
+		aircraft.lastBaroSetting = now
+	}
+
+	if getBits(message, 62, 62) == 1 {
+		aircraft.selectedHeading = float64(getBits(message, 63, 71)) * 180.0 / 256.0
+		aircraft.lastSelectedHeading = now
+	}
+
+	// the mode bits are only meaningful if the status bit is set
+	if getBits(message, 79, 79) == 1 {
+		var modes navMode
+		if getBits(message, 80, 80) == 1 {
+			modes |= navModeAutopilot
+		}
+		if getBits(message, 81, 81) == 1 {
+			modes |= navModeVNAV
+		}
+		if getBits(message, 82, 82) == 1 {
+			modes |= navModeAltHold
+		}
+		if getBits(message, 84, 84) == 1 {
+			modes |= navModeApproach
+		}
+		if getBits(message, 86, 86) == 1 {
+			modes |= navModeLNAV
+		}
+		aircraft.navModes = modes
+		aircraft.lastNavModes = now
+	}
+}
+
+// decodeSurfaceMovement reads ground speed and track from a surface position
+// (ES type 5-8) into the same fields airborne velocity uses.
+func decodeSurfaceMovement(message []byte, aircraft *aircraftData) {
+	now := time.Now()
+
+	if speed := decodeMovementField(getBits(message, 38, 44)); speed >= 0 {
+		aircraft.groundSpeed = speed
+		aircraft.lastGroundSpeed = now
+	}
+
+	if getBits(message, 45, 45) == 1 {
+		aircraft.track = float64(getBits(message, 46, 52)) * 360.0 / 128.0
+		aircraft.lastTrack = now
+	}
+}
+
+// decodeAirborneVelocity handles ES type 19. Subtypes 1 and 2 carry ground
+// speed as east/west and north/south components, 3 and 4 carry airspeed and
+// heading; 2 and 4 are the supersonic variants with 4 knot resolution.
+func decodeAirborneVelocity(message []byte, msgSubType uint, aircraft *aircraftData) {
+	if msgSubType < 1 || msgSubType > 4 {
+		return
+	}
+	now := time.Now()
+
+	scale := 1.0
+	if msgSubType == 2 || msgSubType == 4 {
+		scale = 4.0
+	}
+
+	if msgSubType == 1 || msgSubType == 2 {
+		ewRaw := getBits(message, 47, 56)
+		nsRaw := getBits(message, 58, 67)
+		if ewRaw != 0 && nsRaw != 0 {
+			ewVel := float64(ewRaw-1) * scale
+			if getBits(message, 46, 46) == 1 {
+				ewVel = -ewVel // west
+			}
+			nsVel := float64(nsRaw-1) * scale
+			if getBits(message, 57, 57) == 1 {
+				nsVel = -nsVel // south
+			}
+
+			aircraft.groundSpeed = math.Hypot(ewVel, nsVel)
+			aircraft.track = math.Mod(math.Atan2(ewVel, nsVel)*180.0/math.Pi+360.0, 360.0)
+			aircraft.lastGroundSpeed = now
+			aircraft.lastTrack = now
+		}
+	} else {
+		if getBits(message, 46, 46) == 1 {
+			aircraft.heading = float64(getBits(message, 47, 56)) * 360.0 / 1024.0
+			aircraft.lastHeading = now
+		}
+		if airspeedRaw := getBits(message, 58, 67); airspeedRaw != 0 {
+			aircraft.airspeed = float64(airspeedRaw-1) * scale
+			aircraft.airspeedIsTrue = getBits(message, 57, 57) == 1
+			aircraft.lastAirspeed = now
+		}
+	}
+
+	if vrRaw := getBits(message, 70, 78); vrRaw != 0 {
+		verticalRate := int32(vrRaw-1) * 64
+		if getBits(message, 69, 69) == 1 {
+			verticalRate = -verticalRate
+		}
+		aircraft.verticalRate = verticalRate
+		aircraft.verticalRateGNSS = getBits(message, 68, 68) == 0
+		aircraft.lastVerticalRate = now
+	}
+
+	if diffRaw := getBits(message, 82, 88); diffRaw != 0 {
+		diff := int32(diffRaw-1) * 25
+		if getBits(message, 81, 81) == 1 {
+			diff = -diff // GNSS below baro
+		}
+		aircraft.gnssBaroDiff = diff
+		aircraft.lastGNSSBaroDiff = now
+
+		// fill in the geometric altitude, unless the aircraft has been
+		// sending it directly
+		if aircraft.altitude != math.MaxInt32 &&
+			(aircraft.geomAltitudeDerived || now.Sub(aircraft.lastGeomAltitude) > geomAltitudeMaxAge) {
+			aircraft.geomAltitude = aircraft.altitude + diff
+			aircraft.geomAltitudeDerived = true
+			aircraft.lastGeomAltitude = now
+		}
+	}
+}
+
+// parseRawSurfaceLatLon decodes an even/odd pair of surface CPR positions.
+// Surface encoding uses zones a quarter the size of airborne ones, so each
+// pair has four possible solutions 90 degrees apart; we pick the one closest
+// to refLat/refLon.
+func parseRawSurfaceLatLon(evenLat uint32, evenLon uint32, oddLat uint32,
+	oddLon uint32, lastOdd bool, refLat float64, refLon float64) (latitude float64, longitude float64) {
+	if evenLat == math.MaxUint32 || evenLon == math.MaxUint32 ||
+		oddLat == math.MaxUint32 || oddLon == math.MaxUint32 {
+		return math.MaxFloat64, math.MaxFloat64
+	}
+
+	const sfcdlat0 = float64(90.0) / float64(60.0)
+	const sfcdlat1 = float64(90.0) / float64(59.0)
+
+	j := int(math.Floor((59.0*float64(evenLat)-60.0*float64(oddLat))/131072.0 + 0.5))
+	rlatEven := sfcdlat0 * (float64(cprModFunction(j, 60)) + float64(evenLat)/131072.0)
+	rlatOdd := sfcdlat1 * (float64(cprModFunction(j, 59)) + float64(oddLat)/131072.0)
+
+	// Only the northern (0..90) and southern (-90..0) solutions are real;
+	// take the southern one when it's closer to the reference. 0 encodes
+	// the equator and both poles.
+	rlatEven = surfaceLatitudeNear(rlatEven, refLat)
+	rlatOdd = surfaceLatitudeNear(rlatOdd, refLat)
+
+	if cprNLFunction(rlatEven) != cprNLFunction(rlatOdd) {
+		return math.MaxFloat64, math.MaxFloat64
+	}
+
+	var outLat, outLon float64
+	if lastOdd {
+		nl := int(cprNLFunction(rlatOdd))
+		ni := int(cprNFunction(rlatOdd, true))
+		m := int(math.Floor((float64(evenLon)*float64(nl-1)-float64(oddLon)*float64(nl))/131072.0 + 0.5))
+		outLon = cprDlonFunction(rlatOdd, true, true) * (float64(cprModFunction(m, ni)) + float64(oddLon)/131072.0)
+		outLat = rlatOdd
+	} else {
+		nl := int(cprNLFunction(rlatEven))
+		ni := int(cprNFunction(rlatEven, false))
+		m := int(math.Floor((float64(evenLon)*float64(nl-1)-float64(oddLon)*float64(nl))/131072.0 + 0.5))
+		outLon = cprDlonFunction(rlatEven, false, true) * (float64(cprModFunction(m, ni)) + float64(evenLon)/131072.0)
+		outLat = rlatEven
+	}
+
+	// move from the first quadrant to whichever one is closest to the
+	// reference, then renormalize to -180..180
+	outLon += math.Floor((refLon-outLon+45.0)/90.0) * 90.0
+	outLon -= math.Floor((outLon+180.0)/360.0) * 360.0
+
+	return outLat, outLon
+}
+
+func surfaceLatitudeNear(rlat float64, refLat float64) float64 {
+	if rlat == 0 {
+		if refLat < -45 {
+			return -90
+		} else if refLat > 45 {
+			return 90
+		}
+	} else if rlat-refLat > 45 {
+		return rlat - 90
+	}
+	return rlat
+}
+
+// decodeCPR buffers a raw CPR position and returns the position it resolves
+// to, or math.MaxFloat64 if it can't be resolved yet.
+//
+// A global decode from a recent even/odd pair is always preferred, and is
+// the only way an aircraft gets its first fix. After that, a lone frame can
+// be decoded locally against the aircraft's last position, or failing that
+// against the receiver if -maxRange is small enough to make that unambiguous.
+func decodeCPR(aircraft *aircraftData, rawLat uint32, rawLon uint32,
+	isOddFrame bool, surface bool) (latitude float64, longitude float64) {
+	now := time.Now()
+
+	if surface != aircraft.onGround {
+		// Surface and airborne CPR frames can't be paired up
+		aircraft.eRawLat = math.MaxUint32
+		aircraft.eRawLon = math.MaxUint32
+		aircraft.oRawLat = math.MaxUint32
+		aircraft.oRawLon = math.MaxUint32
+		aircraft.onGround = surface
+	}
+
+	if isOddFrame {
+		aircraft.oRawLat = rawLat
+		aircraft.oRawLon = rawLon
+		aircraft.oRawTime = now
+	} else {
+		aircraft.eRawLat = rawLat
+		aircraft.eRawLon = rawLon
+		aircraft.eRawTime = now
+	}
+
+	hasFix := aircraft.latitude != math.MaxFloat64 && aircraft.longitude != math.MaxFloat64
+
+	maxPairAge := cprAirbornePairMaxAge
+	if surface {
+		maxPairAge = cprSurfacePairMaxAge
+	}
+	pairAge := aircraft.eRawTime.Sub(aircraft.oRawTime)
+	if pairAge < 0 {
+		pairAge = -pairAge
+	}
+
+	if aircraft.eRawLat != math.MaxUint32 && aircraft.oRawLat != math.MaxUint32 &&
+		pairAge <= maxPairAge {
+		if surface {
+			// Surface positions only cover a 90 degree quadrant, so they have
+			// to be resolved against somewhere nearby: the aircraft's last
+			// position if we have one, otherwise the receiver.
+			refLat, refLon := *baseLat, *baseLon
+			if hasFix {
+				refLat, refLon = aircraft.latitude, aircraft.longitude
+			}
+			latitude, longitude = parseRawSurfaceLatLon(aircraft.eRawLat, aircraft.eRawLon,
+				aircraft.oRawLat, aircraft.oRawLon, isOddFrame, refLat, refLon)
+		} else {
+			latitude, longitude = parseRawLatLon(aircraft.eRawLat, aircraft.eRawLon,
+				aircraft.oRawLat, aircraft.oRawLon, isOddFrame)
+		}
+		if latitude != math.MaxFloat64 {
+			return latitude, longitude
+		}
+	}
+
+	if !hasFix {
+		return math.MaxFloat64, math.MaxFloat64
+	}
+
+	if time.Since(aircraft.lastPos) <= cprLocalMaxAge {
+		return parseLocalLatLon(rawLat, rawLon, isOddFrame, surface,
+			aircraft.latitude, aircraft.longitude)
+	}
+
+	if receiverRelativeCPR(surface) {
+		latitude, longitude = parseLocalLatLon(rawLat, rawLon, isOddFrame, surface,
+			*baseLat, *baseLon)
+		if latitude != math.MaxFloat64 &&
+			metersInMiles(greatcircle(latitude, longitude, *baseLat, *baseLon)) <= *maxRange {
+			return latitude, longitude
+		}
+	}
+
+	return math.MaxFloat64, math.MaxFloat64
+}
+
+// positionPlausible checks a freshly decoded position against -maxRange
+// and against how far the aircraft could have moved since its last fix.
+// Rejections are counted; after cprMaxRejections in a row the old position
+// is assumed to be the bad one, and is thrown away so that the next global
+// decode starts over.
+func positionPlausible(aircraft *aircraftData, latitude float64, longitude float64) bool {
+	ok := true
+
+	if *maxRange > 0 &&
+		metersInMiles(greatcircle(latitude, longitude, *baseLat, *baseLon)) > *maxRange {
+		ok = false
+	}
+
+	if ok && aircraft.latitude != math.MaxFloat64 && aircraft.longitude != math.MaxFloat64 {
+		// Use the reported speed if it's recent, with some headroom since it
+		// may have changed, otherwise the fastest thing we'd expect to see.
+		speed := float64(maxPlausibleAirborneSpeed)
+		if aircraft.onGround {
+			speed = maxPlausibleSurfaceSpeed
+		}
+		if time.Since(aircraft.lastGroundSpeed) < 30*time.Second {
+			speed = aircraft.groundSpeed*1.25 + 20
+		}
+
+		elapsed := time.Since(aircraft.lastPos).Seconds()
+		allowed := knotsToMetersPerSecond(speed)*elapsed + positionSlackMeters
+		if greatcircle(latitude, longitude, aircraft.latitude, aircraft.longitude) > allowed {
+			ok = false
+		}
+	}
+
+	if ok {
+		aircraft.posFailures = 0
+		return true
+	}
+
+	aircraft.posRejected++
+	aircraft.posFailures++
+	modesStats.countPositionRejected()
+
+	if aircraft.posFailures >= cprMaxRejections {
+		aircraft.latitude = math.MaxFloat64
+		aircraft.longitude = math.MaxFloat64
+		aircraft.eRawLat = math.MaxUint32
+		aircraft.eRawLon = math.MaxUint32
+		aircraft.oRawLat = math.MaxUint32
+		aircraft.oRawLon = math.MaxUint32
+		aircraft.posFailures = 0
+	}
+	return false
+}
+
+// receiverRelativeCPR reports whether -maxRange is set and small enough for
+// a local decode against the receiver to be unambiguous: it must be under
+// half a latitude zone (180NM airborne, 45NM on the surface).
+func receiverRelativeCPR(surface bool) bool {
+	limit := float64(207.1) // 180NM in miles
+	if surface {
+		limit = 51.7 // 45NM in miles
+	}
+	return *maxRange > 0 && *maxRange <= limit
 }
 
 func parseRawLatLon(evenLat uint32, evenLon uint32, oddLat uint32,
-	oddLon uint32, lastOdd bool, tFlag bool) (latitude float64, longitude float64) {
-	if evenLat == math.MaxUint32 || oddLat == math.MaxUint32 ||
+	oddLon uint32, lastOdd bool) (latitude float64, longitude float64) {
+	if evenLat == math.MaxUint32 || evenLon == math.MaxUint32 ||
 		oddLat == math.MaxUint32 || oddLon == math.MaxUint32 {
 		return math.MaxFloat64, math.MaxFloat64
 	}
@@ -313,14 +1013,14 @@ func parseRawLatLon(evenLat uint32, evenLon uint32, oddLat uint32,
 	//fmt.Printf("Parsing: %d,%d + %d,%d\n", evenLat, evenLon, oddLat, oddLon)
 
 	// http://www.lll.lu/~edward/edward/adsb/DecodingADSBposition.html
-	j := int32((float64(59*evenLat-60*oddLat) / 131072.0) + 0.5)
+	j := int(math.Floor((59.0*float64(evenLat)-60.0*float64(oddLat))/131072.0 + 0.5))
 	//fmt.Println("J: ", j)
 
 	const airdlat0 = float64(6.0)
 	const airdlat1 = float64(360.0) / float64(59.0)
 
-	rlatEven := airdlat0 * (float64(j%60) + float64(evenLat)/131072.0)
-	rlatOdd := airdlat1 * (float64(j%59) + float64(oddLat)/131072.0)
+	rlatEven := airdlat0 * (float64(cprModFunction(j, 60)) + float64(evenLat)/131072.0)
+	rlatOdd := airdlat1 * (float64(cprModFunction(j, 59)) + float64(oddLat)/131072.0)
 	if rlatEven >= 270 {
 		rlatEven -= 360
 	}
@@ -331,6 +1031,10 @@ func parseRawLatLon(evenLat uint32, evenLon uint32, oddLat uint32,
 	//fmt.Println("rlat(0): ", rlatEven)
 	//fmt.Println("rlat(1): ", rlatOdd)
 
+	if rlatEven < -90 || rlatEven > 90 || rlatOdd < -90 || rlatOdd > 90 {
+		return math.MaxFloat64, math.MaxFloat64
+	}
+
 	nlEven := cprNLFunction(rlatEven)
 	nlOdd := cprNLFunction(rlatOdd)
 
@@ -341,42 +1045,67 @@ func parseRawLatLon(evenLat uint32, evenLon uint32, oddLat uint32,
 	//fmt.Println("NL(0): ", nlEven)
 	//fmt.Println("NL(1): ", nlOdd)
 
-	var ni int16
-
-	if lastOdd {
-		ni = int16(nlOdd) - 1
-	} else {
-		ni = int16(nlEven) - 1
-	}
-	if ni < 1 {
-		ni = 1
-	}
-	//fmt.Println("NL(i): ", ni)
-
-	//dlon := 360.0/float64(ni)
-	//fmt.Println("dlon(i):", dlon)
-
-	var m int16
 	var outLat float64
 	var outLon float64
-	if tFlag {
-		m = int16(math.Floor((float64(int32(evenLon*uint32(cprNLFunction(rlatOdd)-1))-
-			int32(oddLon*uint32(cprNLFunction(rlatOdd)))) / 131072.0) + 0.5))
-		outLon = cprDlonFunction(rlatOdd, tFlag, false) * (float64(m%ni) + float64(oddLon)/131072.0)
+	if lastOdd {
+		nl := int(nlOdd)
+		ni := int(cprNFunction(rlatOdd, true))
+		m := int(math.Floor((float64(evenLon)*float64(nl-1)-float64(oddLon)*float64(nl))/131072.0 + 0.5))
+		outLon = cprDlonFunction(rlatOdd, true, false) * (float64(cprModFunction(m, ni)) + float64(oddLon)/131072.0)
 		outLat = rlatOdd
 
 	} else {
-		m = int16(math.Floor((float64(int32(evenLon*uint32(cprNLFunction(rlatEven)-1))-
-			int32(oddLon*uint32(cprNLFunction(rlatEven)))) / 131072.0) + 0.5))
-		outLon = cprDlonFunction(rlatEven, tFlag, false) * (float64(m%ni) + float64(evenLon)/131072.0)
+		nl := int(nlEven)
+		ni := int(cprNFunction(rlatEven, false))
+		m := int(math.Floor((float64(evenLon)*float64(nl-1)-float64(oddLon)*float64(nl))/131072.0 + 0.5))
+		outLon = cprDlonFunction(rlatEven, false, false) * (float64(cprModFunction(m, ni)) + float64(evenLon)/131072.0)
 		outLat = rlatEven
 	}
 
 	outLon -= math.Floor((outLon+180.0)/360.0) * 360.0
 
-	//fmt.Println("M: ", m)
 	//fmt.Println("outLat: ", outLat)
 	//fmt.Println("outLon: ", outLon)
 
 	return outLat, outLon
 }
+
+// parseLocalLatLon decodes a single CPR frame relative to a reference
+// position, which must be within half a zone of the real one (about 180NM
+// airborne, 45NM on the surface). Returns math.MaxFloat64 if the result
+// isn't within half a cell of the reference.
+func parseLocalLatLon(rawLat uint32, rawLon uint32, isOddFrame bool, surface bool,
+	refLat float64, refLon float64) (latitude float64, longitude float64) {
+	fractionalLat := float64(rawLat) / 131072.0
+	fractionalLon := float64(rawLon) / 131072.0
+
+	zones := 60.0
+	if isOddFrame {
+		zones = 59.0
+	}
+	dlat := 360.0 / zones
+	if surface {
+		dlat = 90.0 / zones
+	}
+
+	j := math.Floor(refLat/dlat) + math.Floor(0.5+cprModFloat(refLat, dlat)/dlat-fractionalLat)
+	outLat := dlat * (j + fractionalLat)
+	if outLat < -90 || outLat > 90 || math.Abs(outLat-refLat) > dlat/2 {
+		return math.MaxFloat64, math.MaxFloat64
+	}
+
+	dlon := cprDlonFunction(outLat, isOddFrame, surface)
+	m := math.Floor(refLon/dlon) + math.Floor(0.5+cprModFloat(refLon, dlon)/dlon-fractionalLon)
+	outLon := dlon * (m + fractionalLon)
+	if math.Abs(outLon-refLon) > dlon/2 {
+		return math.MaxFloat64, math.MaxFloat64
+	}
+	// the reference and the position can be either side of the antimeridian
+	if outLon > 180 {
+		outLon -= 360
+	} else if outLon < -180 {
+		outLon += 360
+	}
+
+	return outLat, outLon
+}
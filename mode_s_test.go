@@ -0,0 +1,229 @@
+// This file is part of Simurgh.
+// Copyright © 2016 Mike Tigas. All rights reserved.
+// This file is licensed under the terms of the GNU Affero General
+// Public License, version 3 or later. See the LICENSE.md file.
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+// A repaired frame must not create an aircraft: if the repair was wrong, the
+// made-up address would go on to vouch for AP replies.
+func TestRepairedFramesNeedKnownAddress(t *testing.T) {
+	for _, frame := range crcTestFrames {
+		damaged := append([]byte{}, frame.message...)
+		flipBit(damaged, 40)
+		icaoAddr := uint32(frame.message[1])<<16 | uint32(frame.message[2])<<8 | uint32(frame.message[3])
+
+		knownAircraft := make(aircraftMap)
+		parseModeS(append([]byte{}, damaged...), false, &knownAircraft)
+		if len(knownAircraft) != 0 {
+			t.Errorf("%s: repaired frame created %d aircraft", frame.name, len(knownAircraft))
+		}
+
+		parseModeS(append([]byte{}, frame.message...), false, &knownAircraft)
+		linkFmt := uint(frame.message[0]) >> 3
+		failed := atomic.LoadUint64(&modesStats.crcFailed[linkFmt])
+		parseModeS(append([]byte{}, damaged...), false, &knownAircraft)
+		aircraft, known := knownAircraft[icaoAddr]
+		switch {
+		case !known:
+			t.Errorf("%s: clean frame not accepted", frame.name)
+		case len(frame.message) == 7 && atomic.LoadUint64(&modesStats.crcFailed[linkFmt]) != failed+1:
+			// only squitters are repaired, DF11 is left alone
+			t.Errorf("%s: damaged all-call reply accepted", frame.name)
+		case len(frame.message) == 14 && aircraft.correctedFrames != 1:
+			t.Errorf("%s: repaired frame from a known aircraft not accepted", frame.name)
+		}
+	}
+}
+
+// The position itself has to say whether it came from a repaired frame; the
+// aircraft's count alone can't tell a consumer which data to doubt.
+func TestRepairedPosition(t *testing.T) {
+	even := mustHex("8d40621d58c382d690c8ac2863a7")
+	odd := mustHex("8d40621d58c386435cc412692ad6")
+	damaged := append([]byte{}, odd...)
+	flipBit(damaged, 60)
+
+	knownAircraft := make(aircraftMap)
+	parseModeS(append([]byte{}, even...), false, &knownAircraft)
+	parseModeS(damaged, false, &knownAircraft)
+	aircraft := knownAircraft[0x40621d]
+	if aircraft.lastPos.IsZero() || !aircraft.posQuality.repaired || aircraft.correctedFrames != 1 {
+		t.Fatalf("position from a repaired frame: repaired %v, %d frame(s)",
+			aircraft.posQuality.repaired, aircraft.correctedFrames)
+	}
+
+	parseModeS(append([]byte{}, odd...), false, &knownAircraft)
+	aircraft = knownAircraft[0x40621d]
+	if aircraft.posQuality.repaired || aircraft.correctedFrames != 1 || aircraft.lastCorrected.IsZero() {
+		t.Errorf("clean position: repaired %v, %d frame(s)",
+			aircraft.posQuality.repaired, aircraft.correctedFrames)
+	}
+}
+
+func TestContainmentRadius(t *testing.T) {
+	tests := []struct {
+		version          uint
+		msgType          uint
+		nicA, nicB, nicC bool
+		nic              uint
+		rc               float64
+	}{
+		{0, 11, false, false, false, 8, 185.2},
+		{0, 16, false, false, false, 2, 14816},
+
+		// version 1: one supplement, from the operational status
+		{1, 11, true, false, false, 9, 75},
+		{1, 11, false, false, false, 8, 185.2},
+		{1, 13, true, false, false, 6, 555.6},
+		{1, 13, false, false, false, 6, 926},
+		{1, 16, true, false, false, 3, 7408},
+		{1, 16, false, false, false, 2, 14816},
+		{1, 7, true, false, false, 9, 75},
+
+		// version 2: NIC-A and NIC-B (airborne) or NIC-C (surface)
+		{2, 11, true, true, false, 9, 75},
+		{2, 11, true, false, false, 8, 185.2},
+		{2, 13, false, true, false, 6, 555.6},
+		{2, 13, true, true, false, 6, 1111.2},
+		{2, 13, false, false, false, 6, 926},
+		{2, 16, true, true, false, 3, 7408},
+		{2, 16, true, false, false, 2, 14816},
+		{2, 8, true, false, true, 7, 370.4},
+		{2, 8, false, false, true, 6, 1111.2},
+	}
+	for _, test := range tests {
+		aircraft := aircraftData{
+			adsbVersion:    test.version,
+			nicSupplementA: test.nicA,
+			nicSupplementB: test.nicB,
+			nicSupplementC: test.nicC,
+		}
+		if nic, rc := containmentRadius(test.msgType, &aircraft); nic != test.nic || rc != test.rc {
+			t.Errorf("v%d TC%d A=%v B=%v C=%v: got NIC %d Rc %v, want NIC %d Rc %v",
+				test.version, test.msgType, test.nicA, test.nicB, test.nicC, nic, rc, test.nic, test.rc)
+		}
+	}
+}
+
+func TestDF18Address(t *testing.T) {
+	const addr = 0xabc123
+	df18 := func(cf, me0, me1 byte) []byte {
+		return []byte{18<<3 | cf, 0xab, 0xc1, 0x23, me0, me1, 0, 0, 0, 0, 0, 0, 0, 0}
+	}
+
+	tests := []struct {
+		name    string
+		message []byte
+		known   []uint32
+		want    uint32
+		ok      bool
+	}{
+		{"ADS-B", df18(cfADSB, 4<<3, 0), nil, addr, true},
+		{"ADS-B other", df18(cfADSBOther, 4<<3, 0), nil, addr | nonICAOAddress, true},
+		{"position, IMF=0", df18(cfTISBFine, 11<<3, 0), nil, addr, true},
+		{"position, IMF=1", df18(cfTISBFine, 11<<3|1, 0), nil, addr | nonICAOAddress, true},
+		{"velocity, IMF=0", df18(cfADSR, 19<<3|1, 0x00), nil, addr, true},
+		{"velocity, IMF=1", df18(cfADSR, 19<<3|1, 0x80), nil, addr | nonICAOAddress, true},
+		{"ident, nothing known", df18(cfTISBFine, 4<<3, 0), nil, addr, true},
+		{"ident, non-ICAO known", df18(cfTISBFine, 4<<3, 0),
+			[]uint32{addr | nonICAOAddress}, addr | nonICAOAddress, true},
+		{"ident, both known", df18(cfTISBFine, 4<<3, 0),
+			[]uint32{addr, addr | nonICAOAddress}, addr, true},
+		{"coarse, IMF=1", df18(cfTISBCoarse, 0x80, 0), nil, addr | nonICAOAddress, true},
+		{"management", df18(cfTISBManagement, 0, 0), nil, addr, false},
+	}
+	for _, test := range tests {
+		knownAircraft := make(aircraftMap)
+		for _, known := range test.known {
+			aircraft := newAircraftData(known)
+			knownAircraft[known] = &aircraft
+		}
+		got, ok := df18Address(test.message, addr, &knownAircraft)
+		if got != test.want || ok != test.ok {
+			t.Errorf("%s: got %s %v, want %s %v", test.name, formatAddress(got), ok,
+				formatAddress(test.want), test.ok)
+		}
+	}
+}
+
+// Aircraft we've only heard of through SBS don't vouch for AP addresses
+// until we've decoded a clean frame from them.
+func TestAPRecoveryIgnoresSBSOnly(t *testing.T) {
+	// a DF4 altitude reply with the parity overlaid with 4840d6
+	df4 := []byte{0x20, 0x00, 0x18, 0x38, 0, 0, 0}
+	ap := modesChecksum(df4) ^ 0x4840d6
+	df4[4], df4[5], df4[6] = byte(ap>>16), byte(ap>>8), byte(ap)
+
+	knownAircraft := make(aircraftMap)
+	parseSBSLine("MSG,3,1,1,4840D6,1,2016/01/01,00:00:00.000,2016/01/01,00:00:00.000,,36000,,,,,,,,,,0\n",
+		&knownAircraft)
+	if aircraft := knownAircraft[0x4840d6]; aircraft == nil || aircraft.source != sourceSBS {
+		t.Fatal("SBS line didn't create an SBS-only aircraft")
+	}
+
+	parseModeS(append([]byte{}, df4...), false, &knownAircraft)
+	if knownAircraft[0x4840d6].altitude != 36000 {
+		t.Errorf("AP reply recovered against an SBS-only aircraft")
+	}
+
+	parseModeS(mustHex("5d4840d6f8740f"), false, &knownAircraft)
+	parseModeS(append([]byte{}, df4...), false, &knownAircraft)
+	if aircraft := knownAircraft[0x4840d6]; aircraft.source != sourceModeS || aircraft.altitude == 36000 {
+		t.Errorf("AP reply not recovered after a clean DF11: source %v altitude %d",
+			aircraft.source, aircraft.altitude)
+	}
+}
+
+// A relayed source never replaces a more direct one, so -hideTISB only hides
+// aircraft we've heard about through TIS-B alone.
+func TestDataSourceRanking(t *testing.T) {
+	// identification squitters from 4840d6 with the given DF/CF byte
+	squitter := func(dfcf byte) []byte {
+		message := mustHex("8d4840d6202cc371c32ce0000000")
+		message[0] = dfcf
+		parity := modesChecksum(message)
+		message[11], message[12], message[13] = byte(parity>>16), byte(parity>>8), byte(parity)
+		return message
+	}
+	df11 := mustHex("5d4840d6f8740f")
+	df17 := squitter(17 << 3)
+	tisb := squitter(18<<3 | cfTISBFine)
+	adsr := squitter(18<<3 | cfADSR)
+
+	tests := []struct {
+		name   string
+		frames [][]byte
+		want   dataSource
+	}{
+		{"TIS-B", [][]byte{tisb}, sourceTISB},
+		{"DF11, then TIS-B", [][]byte{df11, tisb}, sourceModeS},
+		{"DF17, then TIS-B", [][]byte{df17, tisb}, sourceADSB},
+		{"TIS-B, then DF17", [][]byte{tisb, df17}, sourceADSB},
+		{"ADS-R, then TIS-B", [][]byte{adsr, tisb}, sourceADSR},
+		{"TIS-B, then ADS-R", [][]byte{tisb, adsr}, sourceADSR},
+		{"ADS-R, then DF17", [][]byte{adsr, df17}, sourceADSB},
+	}
+	for _, test := range tests {
+		knownAircraft := make(aircraftMap)
+		for _, frame := range test.frames {
+			parseModeS(append([]byte{}, frame...), false, &knownAircraft)
+		}
+		if aircraft := knownAircraft[0x4840d6]; aircraft == nil || aircraft.source != test.want {
+			t.Errorf("%s: got %+v, want source %v", test.name, aircraft, test.want)
+		}
+	}
+
+	// an SBS-only aircraft becomes a TIS-B one, not a Mode S one
+	knownAircraft := make(aircraftMap)
+	parseSBSLine("MSG,3,1,1,4840D6,1,2016/01/01,00:00:00.000,2016/01/01,00:00:00.000,,36000,,,,,,,,,,0\n",
+		&knownAircraft)
+	parseModeS(append([]byte{}, tisb...), false, &knownAircraft)
+	if aircraft := knownAircraft[0x4840d6]; aircraft.source != sourceTISB {
+		t.Errorf("SBS, then TIS-B: got source %v, want TIS-B", aircraft.source)
+	}
+}
@@ -0,0 +1,119 @@
+// This file is part of Simurgh.
+// Copyright © 2016 Mike Tigas. All rights reserved.
+// This file is licensed under the terms of the GNU Affero General
+// Public License, version 3 or later. See the LICENSE.md file.
+//
+// Some functions in this file are ported from code in mutability/dump1090
+// <https://github.com/mutability/dump1090>, under the GNU Public
+// License v2.
+package main
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// Mode A/C replies carry no address, so a single reply could be noise.
+	// Only show codes we've heard a few times recently.
+	modeACMinCount = 5
+	modeACMaxAge   = 30 * time.Second
+
+	// Mode S aircraft heard within this long are candidates for correlation
+	modeACCorrelateAge = 30 * time.Second
+
+	// the SPI (ident) pulse, outside the four octal digits
+	modeASPI = 0x0080
+	// the four octal digits themselves, without SPI or the unused bits
+	modeACCodeMask = 0x7777
+)
+
+// A Mode A/C reply is either an identity (Mode A) or an altitude (Mode C)
+// and nothing in the reply says which, so each distinct code gets its own
+// track and we try it both ways.
+type modeACTrack struct {
+	code     uint  // hex Gillham, 0xABCD; see decodeID13Field
+	altitude int32 // feet, if code is also a valid Mode C altitude
+
+	count     uint
+	firstSeen time.Time
+	lastSeen  time.Time
+
+	// the Mode S aircraft this track belongs to, or math.MaxUint32
+	matched uint32
+}
+type modeACMap map[uint]*modeACTrack
+
+// parseModeAC handles a 2 byte BEAST Mode A/C frame, which holds the reply
+// in hex Gillham form.
+func parseModeAC(message []byte, knownModeAC *modeACMap, knownAircraft *aircraftMap) {
+	reply := uint(message[0])<<8 | uint(message[1])
+	code := reply & modeACCodeMask
+
+	track, exists := (*knownModeAC)[code]
+	if !exists {
+		track = &modeACTrack{
+			code:      code,
+			altitude:  math.MaxInt32,
+			firstSeen: time.Now(),
+			matched:   math.MaxUint32}
+		(*knownModeAC)[code] = track
+	}
+
+	// A reply with the SPI pulse set can't be a Mode C reply, but the same
+	// code can come back later without it
+	if track.altitude == math.MaxInt32 && reply&modeASPI == 0 {
+		track.altitude = gillhamAltitude(code)
+	}
+
+	track.count++
+	track.lastSeen = time.Now()
+	track.matched = correlateModeAC(track, knownAircraft)
+}
+
+// correlateModeAC returns the ICAO address of the one recently heard Mode S
+// aircraft that matches the track, or math.MaxUint32 if there's no match or
+// more than one. A matching squawk wins over a matching altitude.
+func correlateModeAC(track *modeACTrack, knownAircraft *aircraftMap) uint32 {
+	matched := uint32(math.MaxUint32)
+	for icaoAddr, aircraft := range *knownAircraft {
+		if time.Since(aircraft.lastPing) > modeACCorrelateAge ||
+			aircraft.squawk != track.code {
+			continue
+		}
+		if matched != math.MaxUint32 {
+			// shared squawk (e.g. VFR 1200); try the altitude instead
+			matched = math.MaxUint32
+			break
+		}
+		matched = icaoAddr
+	}
+	if matched != math.MaxUint32 || track.altitude == math.MaxInt32 {
+		return matched
+	}
+
+	for icaoAddr, aircraft := range *knownAircraft {
+		if time.Since(aircraft.lastPing) > modeACCorrelateAge ||
+			aircraft.altitude == math.MaxInt32 {
+			continue
+		}
+		// Mode C only has 100ft resolution
+		diff := aircraft.altitude - track.altitude
+		if diff < -100 || diff > 100 {
+			continue
+		}
+		if matched != math.MaxUint32 {
+			return math.MaxUint32
+		}
+		matched = icaoAddr
+	}
+	return matched
+}
+
+// isModeACOnly reports whether a track should be shown as an aircraft of its
+// own: heard often and recently, and not part of a Mode S aircraft.
+func (track *modeACTrack) isModeACOnly() bool {
+	return track.matched == math.MaxUint32 &&
+		track.count >= modeACMinCount &&
+		time.Since(track.lastSeen) <= modeACMaxAge
+}
@@ -0,0 +1,41 @@
+// This file is part of Simurgh.
+// Copyright © 2016 Mike Tigas. All rights reserved.
+// This file is licensed under the terms of the GNU Affero General
+// Public License, version 3 or later. See the LICENSE.md file.
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseModeAC(t *testing.T) {
+	tests := []struct {
+		name     string
+		replies  [][]byte
+		altitude int32
+	}{
+		{"mode C", [][]byte{{0x51, 0x24}}, 35000},
+		{"SPI only", [][]byte{{0x51, 0xa4}}, math.MaxInt32},
+		{"SPI, then mode C", [][]byte{{0x51, 0xa4}, {0x51, 0x24}}, 35000},
+		{"unused bits set", [][]byte{{0xd9, 0x2c}, {0x51, 0x24}}, 35000},
+		{"not an altitude", [][]byte{{0x77, 0x00}}, math.MaxInt32},
+	}
+	for _, test := range tests {
+		knownModeAC := make(modeACMap)
+		knownAircraft := make(aircraftMap)
+		for _, reply := range test.replies {
+			parseModeAC(reply, &knownModeAC, &knownAircraft)
+		}
+		if len(knownModeAC) != 1 {
+			t.Errorf("%s: %d tracks, want 1", test.name, len(knownModeAC))
+			continue
+		}
+		for code, track := range knownModeAC {
+			if track.altitude != test.altitude || track.count != uint(len(test.replies)) {
+				t.Errorf("%s: track %04x altitude %d count %d, want %d count %d", test.name,
+					code, track.altitude, track.count, test.altitude, len(test.replies))
+			}
+		}
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"math"
 	"sort"
+	"sync/atomic"
 	"time"
 )
 
@@ -20,9 +21,16 @@ func durationSecondsElapsed(since time.Duration) string {
 	}
 }
 
-func printAircraftTable(knownAircraft *aircraftMap) {
+func formatSquawk(squawk uint) string {
+	if squawk == math.MaxUint16 {
+		return "----"
+	}
+	return fmt.Sprintf("%04x", squawk)
+}
+
+func printAircraftTable(knownAircraft *aircraftMap, knownModeAC *modeACMap) {
 	fmt.Print("\x1b[H\x1b[2J")
-	fmt.Println("ICAO  \tCallsign\tLocation\t\tAlt\tDistance   Time")
+	fmt.Println("ICAO  \tCallsign\tCat\tSqwk\tLocation\t\tAlt\tDistance   Time")
 
 	sortedAircraft := make(aircraftList, 0, len(*knownAircraft))
 
@@ -33,6 +41,10 @@ func printAircraftTable(knownAircraft *aircraftMap) {
 	sort.Sort(sortedAircraft)
 
 	for _, aircraft := range sortedAircraft {
+		if hiddenCategories[aircraft.category] ||
+			(*hideTISB && aircraft.source == sourceTISB) {
+			continue
+		}
 		/*
 			if time.Since(aircraft.lastPos) > (time.Duration(45) * time.Second) {
 				continue
@@ -42,23 +54,36 @@ func printAircraftTable(knownAircraft *aircraftMap) {
 		extraStale := (time.Since(aircraft.lastPos) > (time.Duration(20) * time.Second))
 
 		aircraftHasLocation := (aircraft.latitude != math.MaxFloat64 &&
-			aircraft.longitude != math.MaxFloat64)
+			aircraft.longitude != math.MaxFloat64 &&
+			(aircraft.mlat || !aircraft.posQuality.reported ||
+				aircraft.posQuality.nic >= *minNIC))
 		aircraftHasAltitude := aircraft.altitude != math.MaxInt32
+		aircraftHasSquawk := aircraft.squawk != math.MaxUint16
+		aircraftHasAlert := aircraft.activeAlerts != 0
 
 		//if !aircraftHasLocation {
 		//	continue
 		//}
 
-		if aircraft.callsign != "" || aircraftHasLocation || aircraftHasAltitude {
+		if aircraft.callsign != "" || aircraftHasLocation || aircraftHasAltitude || aircraftHasSquawk {
 			var sLatLon string
 			var sAlt string
+			sSquawk := formatSquawk(aircraft.squawk)
+
+			// highlight aircraft with an active alert in red
+			hl, hlEnd := "", ""
+			if aircraftHasAlert {
+				hl, hlEnd = "\x1b[1;37;41m", "\x1b[0m"
+			}
 
 			if aircraftHasLocation {
 				sLatLon = fmt.Sprintf("%f,%f", aircraft.latitude, aircraft.longitude)
 			} else {
 				sLatLon = "---.------,---.------"
 			}
-			if aircraftHasAltitude {
+			if aircraftHasAltitude && aircraft.altitudeUnit == altitudeUnitMeters {
+				sAlt = fmt.Sprintf("%dm", feetToMeters(aircraft.altitude))
+			} else if aircraftHasAltitude {
 				sAlt = fmt.Sprintf("%d", aircraft.altitude)
 			} else {
 				sAlt = "-----"
@@ -67,31 +92,190 @@ func printAircraftTable(knownAircraft *aircraftMap) {
 			distance := greatcircle(aircraft.latitude, aircraft.longitude,
 				*baseLat, *baseLon)
 
+			// MLAT positions are marked "^", low integrity ADS-B ones "!",
+			// and ones from a repaired frame "*"
 			isMlat := ""
 			if aircraft.mlat {
 				isMlat = "^"
+			} else if aircraftHasLocation && aircraft.posQuality.lowIntegrity() {
+				isMlat = "!"
+			}
+			if aircraftHasLocation && aircraft.posQuality.repaired {
+				isMlat += "*"
 			}
 
 			//tPing := time.Since(aircraft.lastPing)
 			tPos := time.Since(aircraft.lastPos)
 
 			if !stale && !extraStale {
-				fmt.Printf("%06x\t%8s\t%s%s\t%s\t%3.2f\t%s\n",
-					aircraft.icaoAddr, aircraft.callsign,
+				fmt.Printf("%s%s\t%8s\t%s\t%s\t%s%s\t%s\t%3.2f\t%s%s\n",
+					hl, formatAddress(aircraft.icaoAddr), aircraft.callsign,
+					formatCategory(aircraft.category), sSquawk,
 					sLatLon, isMlat, sAlt, metersInMiles(distance),
-					durationSecondsElapsed(tPos))
+					durationSecondsElapsed(tPos), hlEnd)
 			} else if stale && !extraStale {
-				fmt.Printf("%06x\t%8s\t%s%s?\t%s\t%3.2f?\t%s\n",
-					aircraft.icaoAddr, aircraft.callsign,
+				fmt.Printf("%s%s\t%8s\t%s\t%s\t%s%s?\t%s\t%3.2f?\t%s%s\n",
+					hl, formatAddress(aircraft.icaoAddr), aircraft.callsign,
+					formatCategory(aircraft.category), sSquawk,
 					sLatLon, isMlat, sAlt, metersInMiles(distance),
-					durationSecondsElapsed(tPos))
+					durationSecondsElapsed(tPos), hlEnd)
 			} else if extraStale {
-				fmt.Printf("%06x\t%8s\t%s%s?\t%s\t%3.2f?\t%s…\n",
-					aircraft.icaoAddr, aircraft.callsign,
+				fmt.Printf("%s%s\t%8s\t%s\t%s\t%s%s?\t%s\t%3.2f?\t%s…%s\n",
+					hl, formatAddress(aircraft.icaoAddr), aircraft.callsign,
+					formatCategory(aircraft.category), sSquawk,
 					sLatLon, isMlat, sAlt, metersInMiles(distance),
-					durationSecondsElapsed(tPos))
+					durationSecondsElapsed(tPos), hlEnd)
 			}
 		}
 	}
+	printModeACTracks(knownModeAC)
 	//fmt.Println()
+
+	if len(upstreams) > 0 {
+		fmt.Println()
+		for _, source := range upstreams {
+			fmt.Println("Source", source)
+		}
+	}
+
+	if *showStats {
+		printModeSStats()
+		printAirAirDetails(sortedAircraft)
+		printFrameDetails(sortedAircraft)
+	}
+}
+
+// printAirAirDetails lists what aircraft have said about themselves in
+// replies to ACAS interrogations (DF0/16): the VS (airborne or on the
+// ground) and RI fields.
+func printAirAirDetails(sortedAircraft aircraftList) {
+	fmt.Println()
+	fmt.Println("ICAO  \tVS\tACAS\t\t\tMax speed")
+	for _, aircraft := range sortedAircraft {
+		if aircraft.lastACASCapability.IsZero() && aircraft.lastMaxAirspeed.IsZero() {
+			continue
+		}
+
+		sVS := "air"
+		if aircraft.lastVerticalStatus.IsZero() {
+			sVS = "-"
+		} else if aircraft.vsOnGround {
+			sVS = "ground"
+		}
+		sACAS := "-"
+		if !aircraft.lastACASCapability.IsZero() {
+			sACAS = formatACASCapability(aircraft.acasCapability)
+		}
+		sSpeed := "-"
+		if !aircraft.lastMaxAirspeed.IsZero() {
+			sSpeed = formatMaxAirspeed(aircraft.maxAirspeed)
+		}
+
+		fmt.Printf("%s\t%s\t%-16s\t%s\n", formatAddress(aircraft.icaoAddr), sVS, sACAS, sSpeed)
+	}
+}
+
+// printFrameDetails lists aircraft we've had to repair frames from, or
+// thrown positions out for: how many frames were repaired and how long ago
+// the last one was, and how many positions failed the sanity check.
+func printFrameDetails(sortedAircraft aircraftList) {
+	fmt.Println()
+	fmt.Println("ICAO  \tRepaired\tLast\tPos rejected")
+	for _, aircraft := range sortedAircraft {
+		if aircraft.correctedFrames == 0 && aircraft.posRejected == 0 {
+			continue
+		}
+
+		sLast := "-"
+		if !aircraft.lastCorrected.IsZero() {
+			sLast = durationSecondsElapsed(time.Since(aircraft.lastCorrected))
+		}
+
+		fmt.Printf("%s\t%8d\t%s\t%12d\n", formatAddress(aircraft.icaoAddr),
+			aircraft.correctedFrames, sLast, aircraft.posRejected)
+	}
+}
+
+func formatACASCapability(ri uint) string {
+	switch ri {
+	case 0:
+		return "none"
+	case 2:
+		return "RAs inhibited"
+	case 3:
+		return "vertical RAs"
+	case 4:
+		return "vert+horiz RAs"
+	}
+	return fmt.Sprintf("RI %d", ri)
+}
+
+// formatMaxAirspeed gives the range of the RI 8-14 maximum cruising
+// airspeed codes.
+func formatMaxAirspeed(ri uint) string {
+	switch ri {
+	case 9:
+		return "<=75kt"
+	case 10:
+		return "75-150kt"
+	case 11:
+		return "150-300kt"
+	case 12:
+		return "300-600kt"
+	case 13:
+		return "600-1200kt"
+	case 14:
+		return ">1200kt"
+	}
+	return "no data"
+}
+
+// printModeACTracks lists Mode A/C codes that don't belong to any Mode S
+// aircraft, marked "A/C" in place of an ICAO address. There's no position,
+// and the altitude is only shown if the code is also a valid Mode C reply.
+func printModeACTracks(knownModeAC *modeACMap) {
+	tracks := make([]*modeACTrack, 0)
+	for _, track := range *knownModeAC {
+		if track.isModeACOnly() {
+			tracks = append(tracks, track)
+		}
+	}
+	sort.Slice(tracks, func(i, j int) bool { return tracks[i].code < tracks[j].code })
+
+	for _, track := range tracks {
+
+		sAlt := "-----"
+		if track.altitude != math.MaxInt32 {
+			sAlt = fmt.Sprintf("%d", track.altitude)
+		}
+
+		fmt.Printf("A/C   \t%8s\t%s\t%04x\t%s\t%s\t%s\t%s\n",
+			"", formatCategory(0), track.code, "---.------,---.------", sAlt, "  -",
+			durationSecondsElapsed(time.Since(track.lastSeen)))
+	}
+}
+
+func printModeSStats() {
+	fmt.Println()
+	fmt.Println("DF\tAccepted\tCRC fail\tRecovered\tCorrected")
+	for linkFmt := range modesStats.accepted {
+		accepted := atomic.LoadUint64(&modesStats.accepted[linkFmt])
+		crcFailed := atomic.LoadUint64(&modesStats.crcFailed[linkFmt])
+		recovered := atomic.LoadUint64(&modesStats.recovered[linkFmt])
+		corrected := atomic.LoadUint64(&modesStats.corrected[linkFmt])
+		if accepted == 0 && crcFailed == 0 {
+			continue
+		}
+		fmt.Printf("%d\t%8d\t%8d\t%9d\t%9d\n", linkFmt, accepted, crcFailed,
+			recovered, corrected)
+	}
+	fmt.Printf("Positions rejected: %d\n", atomic.LoadUint64(&modesStats.positionsRejected))
+
+	fmt.Print("Comm-B:")
+	for bds := range modesStats.commB {
+		if n := atomic.LoadUint64(&modesStats.commB[bds]); n != 0 {
+			fmt.Printf(" %X,%X %d", bds>>4, bds&0xF, n)
+		}
+	}
+	fmt.Printf(" ambiguous %d\n", atomic.LoadUint64(&modesStats.commBAmbiguous))
 }
@@ -0,0 +1,187 @@
+// This file is part of Simurgh.
+// Copyright © 2016 Mike Tigas. All rights reserved.
+// This file is licensed under the terms of the GNU Affero General
+// Public License, version 3 or later. See the LICENSE.md file.
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SBS BaseStation CSV, as on dump1090's port 30003. Unlike BEAST and AVR the
+// messages are already decoded, so they're merged straight into the
+// aircraft. Only MSG lines carry aircraft data; a MSG line has 22 fields:
+//
+//	MSG,<type>,<session>,<aircraft>,<hex ident>,<flight>,<date/time
+//	generated x2>,<date/time logged x2>,<callsign>,<altitude>,<ground
+//	speed>,<track>,<lat>,<lon>,<vertical rate>,<squawk>,<alert>,
+//	<emergency>,<SPI>,<on ground>
+//
+// Which fields are filled in depends on the type (1-8), so we just take
+// whatever isn't empty. Flags are "-1" for true and "0" for false.
+// http://woodair.net/sbs/article/barebones42_socket_data.htm
+const sbsMessagePrefix = "MSG,"
+
+const (
+	sbsFieldType = iota + 1
+	sbsFieldSession
+	sbsFieldAircraftID
+	sbsFieldHexIdent
+	sbsFieldFlightID
+	sbsFieldDateGenerated
+	sbsFieldTimeGenerated
+	sbsFieldDateLogged
+	sbsFieldTimeLogged
+	sbsFieldCallsign
+	sbsFieldAltitude
+	sbsFieldGroundSpeed
+	sbsFieldTrack
+	sbsFieldLatitude
+	sbsFieldLongitude
+	sbsFieldVerticalRate
+	sbsFieldSquawk
+	sbsFieldAlert
+	sbsFieldEmergency
+	sbsFieldSPI
+	sbsFieldOnGround
+
+	sbsFieldCount
+)
+
+// handleSBS reads SBS lines until the stream ends.
+func handleSBS(reader *bufio.Reader, knownAircraft *aircraftMap) error {
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		aircraftLock.Lock()
+		parseSBSLine(line, knownAircraft)
+		aircraftLock.Unlock()
+	}
+}
+
+// parseSBSLine merges one MSG line into the aircraft it's about. Anything
+// else, and lines that don't parse, are ignored.
+func parseSBSLine(line string, knownAircraft *aircraftMap) {
+	fields := strings.Split(strings.TrimSpace(line), ",")
+	if len(fields) < sbsFieldCount || fields[0] != "MSG" {
+		return
+	}
+	if msgType, err := strconv.Atoi(fields[sbsFieldType]); err != nil || msgType < 1 || msgType > 8 {
+		return
+	}
+
+	icaoAddr, err := parseSBSAddress(fields[sbsFieldHexIdent])
+	if err != nil {
+		return
+	}
+
+	var aircraft aircraftData
+	if ptrAircraft, exists := (*knownAircraft)[icaoAddr]; exists {
+		aircraft = *ptrAircraft
+	} else {
+		aircraft = newAircraftData(icaoAddr)
+		// until we decode a frame from it ourselves
+		aircraft.setSource(sourceSBS)
+	}
+	now := time.Now()
+	aircraft.lastPing = now
+
+	if callsign := strings.TrimSpace(fields[sbsFieldCallsign]); callsign != "" {
+		aircraft.callsign = fmt.Sprintf("%-8s", callsign)
+	}
+	if altitude, err := strconv.ParseInt(fields[sbsFieldAltitude], 10, 32); err == nil {
+		aircraft.altitude = int32(altitude)
+		aircraft.altitudeUnit = altitudeUnitFeet
+	}
+	if groundSpeed, err := strconv.ParseFloat(fields[sbsFieldGroundSpeed], 64); err == nil {
+		aircraft.groundSpeed = groundSpeed
+		aircraft.lastGroundSpeed = now
+	}
+	if track, err := strconv.ParseFloat(fields[sbsFieldTrack], 64); err == nil {
+		aircraft.track = track
+		aircraft.lastTrack = now
+	}
+	if verticalRate, err := strconv.ParseInt(fields[sbsFieldVerticalRate], 10, 32); err == nil {
+		aircraft.verticalRate = int32(verticalRate)
+		aircraft.lastVerticalRate = now
+	}
+
+	// the squawk is four octal digits, which is what hex Gillham form looks
+	// like when printed in hex
+	if squawk := fields[sbsFieldSquawk]; len(squawk) == 4 && strings.Trim(squawk, "01234567") == "" {
+		code, _ := strconv.ParseUint(squawk, 16, 16)
+		aircraft.setSquawk(uint(code))
+	}
+
+	if alert, ok := parseSBSFlag(fields[sbsFieldAlert]); ok {
+		aircraft.fsAlert = alert
+	}
+	if spi, ok := parseSBSFlag(fields[sbsFieldSPI]); ok {
+		aircraft.fsSPI = spi
+	}
+	if onGround, ok := parseSBSFlag(fields[sbsFieldOnGround]); ok {
+		aircraft.onGround = onGround
+	}
+	// The emergency flag is set for squawks 7500/7600/7700, which have
+	// alerts of their own, so only count it as an emergency state when
+	// the squawk doesn't explain it. A clear flag only clears the state
+	// for aircraft we only know through SBS; otherwise it could be wiping
+	// out the state we decoded from ES type 28, which says more.
+	if emergency, ok := parseSBSFlag(fields[sbsFieldEmergency]); ok {
+		if emergency && aircraft.squawk != 0x7500 && aircraft.squawk != 0x7600 &&
+			aircraft.squawk != 0x7700 {
+			aircraft.emergencyState = 1 // general emergency
+		} else if !emergency && aircraft.source == sourceSBS {
+			aircraft.emergencyState = 0
+		}
+	}
+
+	lat, latErr := strconv.ParseFloat(fields[sbsFieldLatitude], 64)
+	lon, lonErr := strconv.ParseFloat(fields[sbsFieldLongitude], 64)
+	if latErr == nil && lonErr == nil && math.Abs(lat) <= 90 && math.Abs(lon) <= 180 &&
+		positionPlausible(&aircraft, lat, lon) {
+		aircraft.latitude = lat
+		aircraft.longitude = lon
+		aircraft.lastPos = now
+		aircraft.mlat = false
+		aircraft.posQuality = positionQuality{}
+	}
+
+	checkAlerts(&aircraft)
+	(*knownAircraft)[icaoAddr] = &aircraft
+}
+
+// parseSBSAddress reads the hex ident field; dump1090 puts a "~" in front
+// of non-ICAO addresses.
+func parseSBSAddress(field string) (uint32, error) {
+	nonICAO := strings.HasPrefix(field, "~")
+	addr, err := strconv.ParseUint(strings.TrimPrefix(field, "~"), 16, 24)
+	if err != nil {
+		return 0, err
+	}
+	if nonICAO {
+		return uint32(addr) | nonICAOAddress, nil
+	}
+	return uint32(addr), nil
+}
+
+func parseSBSFlag(field string) (value, ok bool) {
+	switch field {
+	case "-1", "1":
+		return true, true
+	case "0":
+		return false, true
+	}
+	return false, false
+}
@@ -0,0 +1,195 @@
+// This file is part of Simurgh.
+// Copyright © 2016 Mike Tigas. All rights reserved.
+// This file is licensed under the terms of the GNU Affero General
+// Public License, version 3 or later. See the LICENSE.md file.
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// sbsLine builds a MSG line with the given fields filled in.
+func sbsLine(msgType int, hexIdent string, values map[int]string) string {
+	fields := make([]string, sbsFieldCount)
+	fields[0] = "MSG"
+	fields[sbsFieldType] = strconv.Itoa(msgType)
+	fields[sbsFieldHexIdent] = hexIdent
+	fields[sbsFieldDateGenerated] = "2016/01/01"
+	fields[sbsFieldTimeGenerated] = "10:00:00.000"
+	for field, value := range values {
+		fields[field] = value
+	}
+	return strings.Join(fields, ",") + "\r\n"
+}
+
+func TestParseSBSLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		prepare func(knownAircraft aircraftMap)
+		lines   []string
+		addr    uint32
+		check   func(aircraft *aircraftData) bool
+	}{
+		{
+			name:  "identification",
+			lines: []string{sbsLine(1, "4840D6", map[int]string{sbsFieldCallsign: "KLM1023"})},
+			addr:  0x4840d6,
+			check: func(aircraft *aircraftData) bool {
+				return aircraft.callsign == "KLM1023 " && aircraft.source == sourceSBS
+			},
+		},
+		{
+			name: "airborne position",
+			lines: []string{sbsLine(3, "4840D6", map[int]string{
+				sbsFieldAltitude: "37000", sbsFieldLatitude: "40.5", sbsFieldLongitude: "-73.9"})},
+			addr: 0x4840d6,
+			check: func(aircraft *aircraftData) bool {
+				return aircraft.altitude == 37000 && aircraft.latitude == 40.5 &&
+					aircraft.longitude == -73.9 && !aircraft.posQuality.reported
+			},
+		},
+		{
+			name:  "position out of range",
+			lines: []string{sbsLine(3, "4840D6", map[int]string{sbsFieldLatitude: "91", sbsFieldLongitude: "0"})},
+			addr:  0x4840d6,
+			check: func(aircraft *aircraftData) bool {
+				return aircraft.latitude == math.MaxFloat64 && aircraft.lastPos.IsZero()
+			},
+		},
+		{
+			name: "velocity",
+			lines: []string{sbsLine(4, "4840D6", map[int]string{
+				sbsFieldGroundSpeed: "450", sbsFieldTrack: "271.5", sbsFieldVerticalRate: "-640"})},
+			addr: 0x4840d6,
+			check: func(aircraft *aircraftData) bool {
+				return aircraft.groundSpeed == 450 && aircraft.track == 271.5 &&
+					aircraft.verticalRate == -640
+			},
+		},
+		{
+			name:  "squawk",
+			lines: []string{sbsLine(6, "4840D6", map[int]string{sbsFieldSquawk: "1234"})},
+			addr:  0x4840d6,
+			check: func(aircraft *aircraftData) bool {
+				return aircraft.squawk == 0x1234
+			},
+		},
+		{
+			name:  "squawk that isn't octal",
+			lines: []string{sbsLine(6, "4840D6", map[int]string{sbsFieldSquawk: "1289"})},
+			addr:  0x4840d6,
+			check: func(aircraft *aircraftData) bool {
+				return aircraft.squawk == math.MaxUint16
+			},
+		},
+		{
+			name: "flags",
+			lines: []string{sbsLine(5, "4840D6", map[int]string{
+				sbsFieldAlert: "-1", sbsFieldSPI: "-1", sbsFieldOnGround: "-1"})},
+			addr: 0x4840d6,
+			check: func(aircraft *aircraftData) bool {
+				return aircraft.fsAlert && aircraft.fsSPI && aircraft.onGround &&
+					aircraft.lastVerticalStatus.IsZero()
+			},
+		},
+		{
+			name: "flags cleared",
+			lines: []string{
+				sbsLine(5, "4840D6", map[int]string{sbsFieldAlert: "-1", sbsFieldOnGround: "-1"}),
+				sbsLine(5, "4840D6", map[int]string{sbsFieldAlert: "0", sbsFieldOnGround: "0"}),
+			},
+			addr: 0x4840d6,
+			check: func(aircraft *aircraftData) bool {
+				return !aircraft.fsAlert && !aircraft.onGround
+			},
+		},
+		{
+			name:  "emergency flag",
+			lines: []string{sbsLine(6, "4840D6", map[int]string{sbsFieldSquawk: "1234", sbsFieldEmergency: "-1"})},
+			addr:  0x4840d6,
+			check: func(aircraft *aircraftData) bool {
+				return aircraft.emergencyState == 1
+			},
+		},
+		{
+			name:  "emergency squawk",
+			lines: []string{sbsLine(6, "4840D6", map[int]string{sbsFieldSquawk: "7700", sbsFieldEmergency: "-1"})},
+			addr:  0x4840d6,
+			check: func(aircraft *aircraftData) bool {
+				return aircraft.emergencyState == 0 && aircraft.squawk == 0x7700
+			},
+		},
+		{
+			name: "emergency over",
+			lines: []string{
+				sbsLine(6, "4840D6", map[int]string{sbsFieldEmergency: "-1"}),
+				sbsLine(6, "4840D6", map[int]string{sbsFieldEmergency: "0"}),
+			},
+			addr: 0x4840d6,
+			check: func(aircraft *aircraftData) bool {
+				return aircraft.emergencyState == 0
+			},
+		},
+		{
+			// a clear flag doesn't wipe out what ES type 28 told us
+			name: "emergency from ADS-B",
+			prepare: func(knownAircraft aircraftMap) {
+				aircraft := newAircraftData(0x4840d6)
+				aircraft.source = sourceADSB
+				aircraft.emergencyState = 4 // no communications
+				knownAircraft[0x4840d6] = &aircraft
+			},
+			lines: []string{sbsLine(6, "4840D6", map[int]string{sbsFieldEmergency: "0"})},
+			addr:  0x4840d6,
+			check: func(aircraft *aircraftData) bool {
+				return aircraft.emergencyState == 4 && aircraft.source == sourceADSB
+			},
+		},
+		{
+			name:  "non-ICAO address",
+			lines: []string{sbsLine(8, "~abcdef", map[int]string{sbsFieldOnGround: "0"})},
+			addr:  0xabcdef | nonICAOAddress,
+			check: func(aircraft *aircraftData) bool {
+				return aircraft.icaoAddr == 0xabcdef|nonICAOAddress
+			},
+		},
+	}
+
+	for _, test := range tests {
+		knownAircraft := make(aircraftMap)
+		if test.prepare != nil {
+			test.prepare(knownAircraft)
+		}
+		for _, line := range test.lines {
+			parseSBSLine(line, &knownAircraft)
+		}
+		aircraft, known := knownAircraft[test.addr]
+		if !known {
+			t.Errorf("%s: no aircraft %s", test.name, formatAddress(test.addr))
+		} else if !test.check(aircraft) {
+			t.Errorf("%s: got %+v", test.name, aircraft)
+		}
+	}
+}
+
+func TestParseSBSLineIgnored(t *testing.T) {
+	full := sbsLine(1, "4840D6", map[int]string{sbsFieldCallsign: "KLM1023"})
+	for _, line := range []string{
+		"",
+		"junk\n",
+		strings.Replace(full, "MSG", "SEL", 1),
+		strings.Replace(full, "MSG,1,", "MSG,9,", 1),
+		strings.Replace(full, "4840D6", "4840DX", 1),
+		strings.Replace(full, "4840D6", "1234567", 1),
+		full[:strings.LastIndex(full, ",")], // a field short
+	} {
+		knownAircraft := make(aircraftMap)
+		parseSBSLine(line, &knownAircraft)
+		if len(knownAircraft) != 0 {
+			t.Errorf("%q: created %d aircraft", line, len(knownAircraft))
+		}
+	}
+}
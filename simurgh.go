@@ -8,32 +8,110 @@ import (
 	"bufio"
 	"flag"
 	"fmt"
+	"io"
 	"net"
-	"reflect"
+	"os"
+	"sync"
 	"time"
 )
 
-var magicTimestampMLAT = []byte{0xFF, 0x00, 0x4D, 0x4C, 0x41, 0x54}
-
 const (
 	aisCharset       = "@ABCDEFGHIJKLMNOPQRSTUVWXYZ[\\]^_ !\"#$%&'()*+,-./0123456789:;<=>?"
 	sortModeLastPos  = uint(0)
 	sortModeDistance = uint(1)
 	sortModeCallsign = uint(2)
+
+	// how far apart an even/odd CPR pair can be for a global decode
+	cprAirbornePairMaxAge = 10 * time.Second
+	cprSurfacePairMaxAge  = 25 * time.Second
+	// how old a position can be and still be used for a local decode
+	cprLocalMaxAge = 60 * time.Second
+	// implausible positions in a row before an aircraft's position is reset
+	cprMaxRejections = 3
+
+	// speed limits (knots) for the position sanity check when the aircraft
+	// hasn't reported its own speed, plus slack for CPR resolution
+	maxPlausibleAirborneSpeed = 1000
+	maxPlausibleSurfaceSpeed  = 100
+	positionSlackMeters       = 1000.0
+
+	// a geometric altitude sent directly isn't replaced by one worked out
+	// from the baro/GNSS difference until it's this old
+	geomAltitudeMaxAge = 30 * time.Second
+
+	// Comm-B values only replace ones from extended squitters once the
+	// aircraft hasn't sent an extended squitter for this long
+	commBMergeAge = 60 * time.Second
+
+	// positions with a NIC below this (containment radius of 0.2 NM or
+	// more) are flagged in the table; 7 is what the FAA's ADS-B Out rule
+	// asks for
+	lowIntegrityNIC = 7
 )
 
+// set from -hideCategories
+var hiddenCategories map[uint]bool
+
+// set from -connect
+var connectAddrs stringList
+
+// Every connection updates the same aircraft, and the table reads them, so
+// they take turns.
+var aircraftLock sync.Mutex
+
+func init() {
+	flag.Var(&connectAddrs, "connect", "\"host:port\" of a BEAST, AVR or SBS source to connect to, e.g. dump1090's port 30005; can be given more than once")
+}
+
 var (
-	listenAddr = flag.String("bind", "127.0.0.1:8081", "\":port\" or \"ip:port\" to bind the server to")
+	listenAddr = flag.String("bind", "127.0.0.1:8081", "\":port\" or \"ip:port\" to bind the server to (\"\": don't listen)")
 	baseLat    = flag.Float64("baseLat", 40.77725, "latitude used for distance calculation")
 	baseLon    = flag.Float64("baseLon", -73.872611, "longitude for distance calculation")
 	sortMode   = flag.Uint("sortMode", sortModeDistance, "0: sort by time, 1: sort by distance, 3: sort by air")
+	showStats  = flag.Bool("stats", false, "print per-DF frame counters, Comm-B registers decoded, air-air reply details, and repaired frames and rejected positions per aircraft below the aircraft table")
+	maxRange   = flag.Float64("maxRange", 0, "receiver range in miles; farther positions are rejected, and nearer ones can be decoded relative to the receiver (0: off)")
+	fixTwoBits = flag.Bool("fixTwoBits", false, "also repair two-bit errors (more false positives)")
+	minNIC     = flag.Uint("minNIC", 0, "don't show ADS-B positions with a NIC (navigation integrity category) below this")
+
+	hideTISB       = flag.Bool("hideTISB", false, "leave aircraft only seen through TIS-B out of the table")
+	hideCategories = flag.String("hideCategories", "", "comma separated emitter categories to leave out of the table, e.g. \"C1,C2\" for ground vehicles")
+
+	alertStderr = flag.Bool("alertStderr", false, "print emergency/ident alerts to stderr")
+	alertLog    = flag.String("alertLog", "", "append emergency/ident alerts to this file")
+	alertExec   = flag.String("alertExec", "", "run this shell command for each alert, with details in SIMURGH_* environment variables")
+
+	acasLog        = flag.String("acasLog", "", "append ACAS resolution advisories to this file, one JSON object per line")
+	acasReport     = flag.String("acasReport", "", "print the RA episodes in this -acasLog file and exit")
+	acasReportICAO = flag.String("acasReportICAO", "", "with -acasReport, only show episodes involving this ICAO address")
 )
 
 func main() {
 	flag.Parse()
 
+	if *acasReport != "" {
+		if err := printACASReport(*acasReport, *acasReportICAO); err != nil {
+			fmt.Fprintln(os.Stderr, "-acasReport:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	var err error
+	if hiddenCategories, err = parseCategoryList(*hideCategories); err != nil {
+		fmt.Fprintln(os.Stderr, "-hideCategories:", err)
+		os.Exit(1)
+	}
+	if err := setupAlertSinks(); err != nil {
+		fmt.Fprintln(os.Stderr, "couldn't set up alerts:", err)
+		os.Exit(1)
+	}
+	if err := setupACASLog(); err != nil {
+		fmt.Fprintln(os.Stderr, "couldn't open the ACAS log:", err)
+		os.Exit(1)
+	}
+
 	// test: http://www.lll.lu/~edward/edward/adsb/DecodingADSBposition.html
-	// parseRawLatLon(uint32(92095), uint32(39846), uint32(88385), uint32(125818), true, false)
+	// parseRawLatLon(uint32(92095), uint32(39846), uint32(88385), uint32(125818), true)
 	// test: http://wiki.modesbeast.com/Radarcape:Firmware_Versions#The_GPS_timestamp
 	//timestamp := parseTime([]byte{0x24, 0x4b, 0xbb, 0x9a, 0xc9, 0xf0})
 	//fmt.Println(timestamp)
@@ -43,10 +121,26 @@ func main() {
 
 	// Primary program state; a big hash table of seen aircraft (pointers)
 	knownAircraft := make(aircraftMap)
+	// Mode A/C replies have no address, so they're tracked separately by code
+	knownModeAC := make(modeACMap)
 
-	// Start our server
-	server, _ := net.Listen("tcp", *listenAddr)
-	conns := startServer(server)
+	// Dial out to any sources we were given
+	for _, addr := range connectAddrs {
+		source := &upstream{addr: addr}
+		upstreams = append(upstreams, source)
+		go runUpstream(source, &knownAircraft, &knownModeAC)
+	}
+
+	// Start our server, unless we're only dialling out
+	var conns chan net.Conn
+	if *listenAddr != "" {
+		server, err := net.Listen("tcp", *listenAddr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "couldn't listen:", err)
+			os.Exit(1)
+		}
+		conns = startServer(server)
+	}
 
 	// Refresh our console output every 500ms.
 	ticker := time.NewTicker(500 * time.Millisecond)
@@ -55,7 +149,9 @@ func main() {
 		for {
 			select {
 			case <-ticker.C:
-				printAircraftTable(&knownAircraft)
+				aircraftLock.Lock()
+				printAircraftTable(&knownAircraft, &knownModeAC)
+				aircraftLock.Unlock()
 			case <-quit:
 				ticker.Stop()
 				return
@@ -63,9 +159,13 @@ func main() {
 		}
 	}()
 
+	if conns == nil {
+		select {}
+	}
+
 	// Handle connections to the server
 	for {
-		go handleConnection(<-conns, &knownAircraft)
+		go handleConnection(<-conns, &knownAircraft, &knownModeAC)
 	}
 }
 
@@ -87,116 +187,87 @@ func startServer(listener net.Listener) chan net.Conn {
 	return ch
 }
 
-func handleConnection(conn net.Conn, knownAircraft *aircraftMap) {
-	reader := bufio.NewReader(conn)
-
-	var bufferedMessage []byte
+// The input formats we accept on a connection
+type inputFormat uint
 
-	// keep the connection alive as long as the client keeps it alive
-	for {
-		// Note this means `message` does not include 0x1A start byte; it
-		// contains the 0x1A start byte of the _next_ message.
-		currentMessage, _ := reader.ReadBytes(0x1A)
+const (
+	inputBEAST = inputFormat(iota)
+	inputAVR
+	inputSBS
+)
 
-		//if err != nil {
-		//	fmt.Println("ERR:", err)
-		//}
+// frameReader is a BEAST or AVR decoder
+type frameReader interface {
+	readFrame() (*beastFrame, error)
+}
 
-		// Connection has closed
-		if len(currentMessage) == 0 {
-			break
+// detectInputFormat works out the format of a stream from the first frame
+// (or line) start in it, skipping anything before that.
+func detectInputFormat(reader *bufio.Reader) (inputFormat, error) {
+	for {
+		c, err := reader.Peek(1)
+		if err != nil {
+			return 0, err
 		}
+		switch c[0] {
+		case beastEscape:
+			return inputBEAST, nil
+		case avrFrameStart, avrFrameWithTimestamp, avrFrameWithSignal, avrFrameWithSignalAlt:
+			return inputAVR, nil
+		case sbsMessagePrefix[0]:
+			if prefix, _ := reader.Peek(len(sbsMessagePrefix)); string(prefix) == sbsMessagePrefix {
+				return inputSBS, nil
+			}
+		}
+		// part of a frame we joined in the middle of
+		reader.ReadByte()
+	}
+}
 
-		// TODO fix order of the next two blocks
+// handleConnection decodes a BEAST, AVR or SBS stream until it ends, whether
+// we accepted the connection or dialled it with -connect. It returns the
+// error that ended it, or nil if the other end closed it.
+func handleConnection(conn net.Conn, knownAircraft *aircraftMap, knownModeAC *modeACMap) error {
+	defer conn.Close()
 
-		// Add to our own buffer (or create it)
-		if bufferedMessage == nil {
-			bufferedMessage = currentMessage
-		} else {
-			bufferedMessage = append(bufferedMessage, currentMessage...)
-		}
+	input := bufio.NewReader(conn)
+	format, err := detectInputFormat(input)
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	}
 
-		// Is this next msg a valid msg? (Check the initial 'message type' byte)
-		// If it is, then process the concatenated message we've buffered.
-		parseBuffer := false
-		if currentMessage[0] == 0x31 || currentMessage[0] == 0x32 ||
-			currentMessage[0] == 0x33 || currentMessage[0] == 0x34 {
-			parseBuffer = true
-		}
-		if !parseBuffer {
-			continue
-		}
+	var reader frameReader
+	switch format {
+	case inputSBS:
+		return handleSBS(input, knownAircraft)
+	case inputAVR:
+		reader = &avrReader{reader: input}
+	default:
+		reader = newBeastReader(input)
+	}
 
-		message := bufferedMessage
-		bufferedMessage = nil
-
-		msgType := message[0]
-		var msgLen int
-
-		switch msgType {
-		case 0x31:
-			//fmt.Print("Type 1 Mode-AC")
-			//msgLen = 10 // 2 + 8 header
-			continue // not supported yet
-		case 0x32:
-			//fmt.Print("Type 2 Mode-S short")
-			//msgLen = 15 // 7 + 8 header
-			continue // later
-		case 0x33:
-			//fmt.Print("Type 3 Mode-S long")
-			msgLen = 22 // 14
-		case 0x34:
-			//fmt.Print("Status Signal")
-			//msgLen = 10 // ??
-			continue // not supported
-		default:
-			continue
-			//msgLen = 8 // shortest possible msg w/header & timetstamp
-		}
+	// keep the connection alive as long as the client keeps it alive
+	for {
+		frame, err := reader.readFrame()
 
-		// Message wasn't long enough to contain the full header (maybe
-		// input stream error), so skip
-		if len(message) < msgLen {
-			continue
+		// Connection has closed
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
 		}
 
-		//fmt.Println()
-		var timestamp time.Time
-		isMlat := reflect.DeepEqual(message[1:7], magicTimestampMLAT)
-		if isMlat {
-			//fmt.Println("FROM MLAT")
-			//otimestamp := parseTime(message[1:7])
-			//fmt.Println(otimestamp)
-			//timestamp = time.Now()
-		} else {
-			timestamp = parseTime(message[1:7])
-			_ = timestamp
-			//fmt.Println(timestamp)
-		}
-		switch msgType {
-		//case 0x31:
-		//  fmt.Println("Type 1 Mode-AC")
-		case 0x32:
-			//fmt.Println("Type 2 Mode-S short")
-		case 0x33:
-			//fmt.Println("Type 3 Mode-S long")
-			//case 0x34:
-			//  fmt.Println("Status Signal")
+		aircraftLock.Lock()
+		switch frame.frameType {
+		case beastFrameModeAC:
+			parseModeAC(frame.payload, knownModeAC, knownAircraft)
+		case beastFrameStatus:
+			// not supported
+		default:
+			parseModeS(frame.payload, frame.isMlat(), knownAircraft)
 		}
-
-		//sigLevel := message[7]
-		//fmt.Printf("Signal: %#02x (%d)\n", sigLevel, sigLevel)
-
-		msgContent := message[8 : len(message)-1]
-		////fmt.Printf("%d byte frame\n", len(msgContent))
-		//for i:= 0; i < len(msgContent); i++ {
-		//  fmt.Printf("%02x", msgContent[i])
-		//}
-		//fmt.Println()
-
-		parseModeS(msgContent, isMlat, knownAircraft)
-		//fmt.Println()
-
-		//printAircraftTable(knownAircraft)
+		aircraftLock.Unlock()
 	}
 }